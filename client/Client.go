@@ -34,6 +34,8 @@ type Client struct {
 	Machine     *machine.Machine
 	callbacks   map[string]chan proto.Reply
 	pipes       map[string]pipe.Pipe
+	// stacks aren't requested until then, after a control plane without stacks didn't answer
+	stacksRetry time.Time
 
 	// Add connection monitoring fields
 	pingInterval time.Duration
@@ -43,6 +45,24 @@ type Client struct {
 
 const responseTimeout = time.Second * 5
 
+const defaultImageGcInterval = time.Hour
+
+const defaultImageCheckInterval = 6 * time.Hour
+
+const defaultFirewallReconcileInterval = 5 * time.Minute
+
+const defaultFirewallReportInterval = time.Minute
+
+// the time the control plane has to be reached again after the host firewall changed, before it's reverted
+const defaultHostFirewallWindow = 2 * time.Minute
+
+const hostFirewallRetry = 10 * time.Second
+
+const defaultGeoIPRefreshInterval = time.Hour
+
+// how long a control plane that didn't answer the stacks request is assumed not to know stacks
+const stacksRetryInterval = time.Hour
+
 func (c *Client) sendRaw(action string, data map[string]interface{}) (string, error) {
 	rid, err := gonanoid.New()
 	if err != nil {
@@ -101,6 +121,14 @@ func (c *Client) handleMessage(msg proto.Incoming) error {
 				{
 					return c.actions()
 				}
+			case "host.firewall":
+				{
+					return c.hostFirewall()
+				}
+			case "geoip":
+				{
+					return c.geoip()
+				}
 			}
 		}
 	}
@@ -114,7 +142,7 @@ func (c *Client) handleListener(listener pipe.Pipe) (err error) {
 	genericFilter := pipe.GenericFilter{}
 	err = json.Unmarshal(jsonData, &genericFilter)
 	if err == nil {
-		for _, container := range c.Machine.Containers {
+		for _, container := range c.Machine.Snapshot() {
 			if container.Id == genericFilter.Container {
 				selectedContainer = &container
 				break
@@ -122,7 +150,9 @@ func (c *Client) handleListener(listener pipe.Pipe) (err error) {
 		}
 	}
 	log.Info("handling container")
-	if selectedContainer != nil {
+	if listener.Event == pipe.EventAllocate || listener.Event == pipe.EventConflicts {
+		err = c.handleMachineListener(&listener, jsonData)
+	} else if selectedContainer != nil {
 		switch listener.Event {
 		case pipe.EventStatus:
 			err = selectedContainer.PipeStatus(listener.Context, c.Cli, &listener)
@@ -136,6 +166,15 @@ func (c *Client) handleListener(listener pipe.Pipe) (err error) {
 				err = selectedContainer.PipeLogs(listener.Context, c.Cli, logFilter.Since, logFilter.Until, logFilter.Limit, &listener)
 			}
 			break
+		case pipe.EventFirewall:
+			firewallFilter := pipe.FirewallFilter{}
+			err = json.Unmarshal(jsonData, &firewallFilter)
+			if err != nil {
+				err = errors.New("unknown firewall filter")
+			} else {
+				err = selectedContainer.PipeFirewall(listener.Context, &listener, firewallFilter.Since, time.Duration(firewallFilter.Interval)*time.Second)
+			}
+			break
 		case pipe.EventPassword:
 			password, err := selectedContainer.ResetPassword()
 			if err == nil {
@@ -145,17 +184,46 @@ func (c *Client) handleListener(listener pipe.Pipe) (err error) {
 				listener.End()
 			}
 			break
+		case pipe.EventDeployKey:
+			deployKeyFilter := pipe.DeployKeyFilter{}
+			err = json.Unmarshal(jsonData, &deployKeyFilter)
+			if err != nil {
+				err = errors.New("unknown deploy key filter")
+				break
+			}
+			var publicKey string
+			publicKey, err = selectedContainer.DeployKey(deployKeyFilter.Rotate)
+			if err == nil {
+				listener.Forward <- listener.Package(pipe.DeployKey{
+					PublicKey: publicKey,
+				})
+				listener.End()
+			}
+			break
 		case pipe.EventGit:
 			gitFilter := pipe.GitFilter{}
 			err = json.Unmarshal(jsonData, &gitFilter)
 			if err != nil {
 				err = errors.New("unknown git filter")
 			} else {
-				err = selectedContainer.Pull(c.Cli, gitFilter.Token, gitFilter.Uri, gitFilter.Branch, gitFilter.Domain)
+				err = selectedContainer.Pull(c.Cli, containers.GitAuth{
+					Domain:     gitFilter.Domain,
+					Uri:        gitFilter.Uri,
+					Token:      gitFilter.Token,
+					Username:   gitFilter.Username,
+					Ssh:        gitFilter.Ssh,
+					KnownHosts: gitFilter.KnownHosts,
+				}, gitFilter.Branch)
+				var rollback *containers.RollbackError
 				if err == nil {
 					listener.Forward <- listener.Package(pipe.Git{
 						Deployed: true,
 					})
+				} else if errors.As(err, &rollback) {
+					listener.Forward <- listener.Package(pipe.Git{
+						Deployed:   false,
+						RolledBack: true,
+					})
 				}
 				listener.End()
 			}
@@ -177,13 +245,61 @@ func (c *Client) handleListener(listener pipe.Pipe) (err error) {
 	return nil
 }
 
+// handleMachineListener handles the events about the whole node, the filter is the request itself
+func (c *Client) handleMachineListener(listener *pipe.Pipe, jsonData []byte) (err error) {
+	switch listener.Event {
+	case pipe.EventAllocate:
+		request := machine.AllocationRequest{}
+		err = json.Unmarshal(jsonData, &request)
+		if err != nil {
+			return errors.New("unknown allocation request")
+		}
+		allocation, err := c.Machine.Allocate(c.Cli, request)
+		if err != nil {
+			return err
+		}
+		listener.Forward <- listener.Package(allocation)
+		listener.End()
+	case pipe.EventConflicts:
+		spec := containers.Container{}
+		err = json.Unmarshal(jsonData, &spec)
+		if err != nil {
+			return errors.New("unknown container spec")
+		}
+		conflicts, err := c.Machine.Conflicts(c.Cli, spec)
+		if err != nil {
+			return err
+		}
+		listener.Forward <- listener.Package(conflicts)
+		listener.End()
+	}
+	return nil
+}
+
 func (c *Client) containers() (err error) {
 	updatedContainers := make([]containers.Container, 0)
 	err = c.MachineSendAndWait("containers", map[string]interface{}{}, &updatedContainers)
 	if err != nil {
 		return err
 	}
-	created, err := c.Machine.UpdateContainers(c.Cli, updatedContainers)
+	updatedStacks := make([]containers.Stack, 0)
+	if time.Now().After(c.stacksRetry) || c.Machine.HasStacks() {
+		err = c.MachineSendAndWait("stacks", map[string]interface{}{}, &updatedStacks)
+		if err != nil && c.Machine.HasStacks() {
+			// the members would be destroyed otherwise
+			return err
+		}
+		if err != nil {
+			// control planes without stacks don't know the action and don't answer, every sync would wait
+			// for the timeout otherwise
+			log.Info("no stacks received, assuming none until ", stacksRetryInterval, " from now: ", err)
+			c.stacksRetry = time.Now().Add(stacksRetryInterval)
+		}
+		if err != nil || updatedStacks == nil {
+			updatedStacks = make([]containers.Stack, 0)
+		}
+	}
+	created, err := c.Machine.UpdateContainers(c.Cli, updatedContainers, updatedStacks)
 	if err != nil {
 		log.Error("update containers failed", err)
 		return err
@@ -197,8 +313,15 @@ func (c *Client) containers() (err error) {
 			return err
 		}
 	}
+	log.Info("reporting images")
+	for _, container := range c.Machine.Snapshot() {
+		err = c.reportImage(container, false)
+		if err != nil {
+			log.Error("image report failed", err)
+		}
+	}
 	log.Info("requesting git status")
-	for _, container := range c.Machine.Containers {
+	for _, container := range c.Machine.Snapshot() {
 		if container.Branch != nil {
 			commit, err := container.GetCommit()
 			if err != nil {
@@ -240,7 +363,63 @@ func (c *Client) handshake() (err error) {
 		log.Fatal(err)
 		return err
 	}
-	return err
+	// the containers the last shutdown stopped are started again once their specs are known
+	err = c.Machine.ResumeContainers(c.Cli)
+	if err != nil {
+		log.Error("unable to resume the containers stopped by the last shutdown: ", err)
+	}
+	// the control plane is reachable, which confirms a host firewall installed before a restart
+	deadline, err := c.Machine.PendingHostFirewall()
+	if err == nil && deadline != nil {
+		err = c.Machine.ConfirmHostFirewall(*deadline)
+	}
+	if err != nil {
+		log.Error("host firewall confirmation failed: ", err)
+	}
+	err = c.hostFirewall()
+	if err != nil {
+		log.Error("host firewall update failed: ", err)
+	}
+	return nil
+}
+
+// hostFirewall installs the host firewall of the machine. A changed firewall is kept once a round trip to the
+// control plane succeeds with it, the previous one is restored when none does within the window
+func (c *Client) hostFirewall() (err error) {
+	var firewall *containers.HostFirewall
+	err = c.MachineSendAndWait("host.firewall", map[string]interface{}{}, &firewall)
+	if err != nil {
+		return err
+	}
+	window := defaultHostFirewallWindow
+	if parsed, err := time.ParseDuration(os.Getenv("FIREWALL_HOST_REVERT_TIMEOUT")); err == nil && parsed > 0 {
+		window = parsed
+	}
+	deadline, err := c.Machine.ApplyHostFirewall(firewall, window)
+	if err != nil {
+		return err
+	}
+	if deadline != nil {
+		go c.confirmHostFirewall(*deadline)
+	}
+	return nil
+}
+
+// confirmHostFirewall retries a round trip to the control plane until it succeeds or the deadline of the
+// pending firewall passes, only that firewall is confirmed
+func (c *Client) confirmHostFirewall(deadline time.Time) {
+	for time.Now().Before(deadline) {
+		err := c.MachineSendAndWait("host.firewall.applied", map[string]interface{}{}, &proto.Reply{})
+		if err == nil {
+			err = c.Machine.ConfirmHostFirewall(deadline)
+			if err != nil {
+				log.Error("host firewall confirmation failed: ", err)
+			}
+			return
+		}
+		log.Warn("unable to reach the control plane with the host firewall: ", err)
+		time.Sleep(hostFirewallRetry)
+	}
 }
 
 func (c *Client) sendHardware() (err error) {
@@ -264,6 +443,12 @@ func (c *Client) MachineSendAndWait(action string, data map[string]interface{},
 	return c.SendAndWait(*c.Id+"."+action, data, result)
 }
 
+// ContainerSend sends a container message without waiting for a reply, used for frequent updates
+func (c *Client) ContainerSend(container containers.Container, action string, data map[string]interface{}) (err error) {
+	_, err = c.sendRaw(*c.Id+".container."+container.Id+"."+action, data)
+	return err
+}
+
 func (c *Client) ContainerSendAndWait(container containers.Container, action string, data map[string]interface{}, result any) (err error) {
 	return c.MachineSendAndWait("container."+container.Id+"."+action, data, result)
 }
@@ -300,6 +485,190 @@ func (c *Client) pingHandler(done chan struct{}) {
 	}
 }
 
+// reportImage sends the digest the container runs, and whether an update is available when checkRegistry is set
+func (c *Client) reportImage(container containers.Container, checkRegistry bool) (err error) {
+	status, err := container.ImageStatus(c.Cli, checkRegistry)
+	if err != nil {
+		return err
+	}
+	ignore := make(map[string]struct{})
+	return c.MachineSendAndWait("containers."+container.Id+".image", map[string]interface{}{
+		"image":           status.Image,
+		"digest":          status.Digest,
+		"latest":          status.Latest,
+		"pinned":          status.Pinned,
+		"updateAvailable": status.UpdateAvailable,
+	}, &ignore)
+}
+
+// imageChecker periodically compares the digest of each container with the current digest of its tag
+func (c *Client) imageChecker(done chan struct{}) {
+	interval := defaultImageCheckInterval
+	if parsed, err := time.ParseDuration(os.Getenv("IMAGE_CHECK_INTERVAL")); err == nil && parsed > 0 {
+		interval = parsed
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, container := range c.Machine.Snapshot() {
+				err := c.reportImage(container, true)
+				if err != nil {
+					log.Error("image check failed for ", container.Id, ": ", err)
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// imageCollector periodically removes the images that are no longer used by any container
+func (c *Client) imageCollector(done chan struct{}) {
+	interval := defaultImageGcInterval
+	if parsed, err := time.ParseDuration(os.Getenv("IMAGE_GC_INTERVAL")); err == nil && parsed > 0 {
+		interval = parsed
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			report, err := c.Machine.CollectImages(c.Cli, machine.GetImagePolicy())
+			if err != nil {
+				log.Error("image gc failed:", err)
+				continue
+			}
+			if len(report.Removed) == 0 {
+				continue
+			}
+			err = c.MachineSendAndWait("images.gc", map[string]interface{}{
+				"removed":   report.Removed,
+				"reclaimed": report.Reclaimed,
+			}, &proto.Reply{})
+			if err != nil {
+				log.Error("image gc report failed:", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// collectFirewalls removes the chains left behind by containers that are gone
+func (c *Client) collectFirewalls() {
+	removed, skipped := c.Machine.CollectFirewalls()
+	if skipped {
+		log.Info("containers are being updated, firewall collection skipped")
+		return
+	}
+	if len(removed) > 0 {
+		log.Warn("collected orphaned firewall chains: ", removed)
+	}
+}
+
+// firewallReconciler collects the orphaned chains at startup, then periodically along with repairing the
+// firewalls that no longer match their containers and reporting the drift
+func (c *Client) firewallReconciler(done chan struct{}) {
+	interval := defaultFirewallReconcileInterval
+	if parsed, err := time.ParseDuration(os.Getenv("FIREWALL_RECONCILE_INTERVAL")); err == nil && parsed > 0 {
+		interval = parsed
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	c.collectFirewalls()
+	for {
+		select {
+		case <-ticker.C:
+			c.collectFirewalls()
+			drifts, skipped := c.Machine.ReconcileFirewalls()
+			if skipped {
+				log.Info("containers are being updated, firewall reconciliation skipped")
+				continue
+			}
+			if len(drifts) == 0 {
+				continue
+			}
+			err := c.MachineSendAndWait("firewall.drift", map[string]interface{}{
+				"drifts": drifts,
+			}, &proto.Reply{})
+			if err != nil {
+				log.Error("firewall drift report failed:", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// geoip downloads the country database published by the control plane
+func (c *Client) geoip() (err error) {
+	update := containers.GeoIPUpdate{}
+	err = c.MachineSendAndWait("geoip", map[string]interface{}{}, &update)
+	if err != nil {
+		return err
+	}
+	if update.Url == "" {
+		return nil
+	}
+	return c.Machine.UpdateGeoIP(update)
+}
+
+// geoipRefresher periodically reloads the country database when it changed on disk
+func (c *Client) geoipRefresher(done chan struct{}) {
+	interval := defaultGeoIPRefreshInterval
+	if parsed, err := time.ParseDuration(os.Getenv("GEOIP_REFRESH_INTERVAL")); err == nil && parsed > 0 {
+		interval = parsed
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := c.Machine.RefreshGeoIP()
+			if err != nil {
+				log.Error("geoip refresh failed:", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// firewallReporter periodically reports the counters of the firewall rules
+func (c *Client) firewallReporter(done chan struct{}) {
+	interval := defaultFirewallReportInterval
+	if parsed, err := time.ParseDuration(os.Getenv("FIREWALL_REPORT_INTERVAL")); err == nil && parsed > 0 {
+		interval = parsed
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			counters, since := c.Machine.FirewallCounters()
+			if len(counters) == 0 {
+				continue
+			}
+			err := c.MachineSendAndWait("firewall.counters", map[string]interface{}{
+				"counters": counters,
+				"since":    since,
+			}, &proto.Reply{})
+			if err != nil {
+				log.Error("firewall counters report failed:", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
 func (c *Client) Start(cli *client.Client) (err error) {
 	c.Cli = cli
 	c.pipes = make(map[string]pipe.Pipe)
@@ -312,10 +681,26 @@ func (c *Client) Start(cli *client.Client) (err error) {
 	c.pongWait = 60 * time.Second     // Wait 60 seconds for pong response
 	c.writeWait = 10 * time.Second    // Wait 10 seconds for write to complete
 
+	if os.Getenv("SKIP_IPTABLES") != "true" {
+		_, err = containers.SelectBackend()
+		if err != nil {
+			return err
+		}
+	}
+	// the ports using countries are validated against it
+	_, err = containers.RefreshGeoIP()
+	if err != nil {
+		log.Error("unable to load the geoip database: ", err)
+	}
 	c.Machine, err = machine.GetMachine(cli)
 	if err != nil {
 		return err
 	}
+	// before connecting, a host firewall cutting the control plane off must be reverted regardless
+	err = c.Machine.ResumeHostFirewall()
+	if err != nil {
+		log.Error("unable to resume the host firewall: ", err)
+	}
 	endpoint := os.Getenv("ENDPOINT")
 	if endpoint == "" {
 		endpoint = "wss://stream.beta.serverbench.io"
@@ -462,6 +847,19 @@ func (c *Client) Start(cli *client.Client) (err error) {
 	if err := c.handshake(); err != nil {
 		return err
 	}
+	go c.imageCollector(done)
+	go c.imageChecker(done)
+	if os.Getenv("SKIP_IPTABLES") != "true" {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		err = containers.StartDropLog(ctx)
+		if err != nil {
+			log.Error("unable to log dropped packets:", err)
+		}
+		go c.firewallReconciler(done)
+		go c.firewallReporter(done)
+		go c.geoipRefresher(done)
+	}
 	// Request queued actions and listen for new ones
 	if err := c.actions(); err != nil {
 		return err
@@ -488,6 +886,17 @@ func (c *Client) Start(cli *client.Client) (err error) {
 	return errors.New("websocket connection closed")
 }
 
+// Shutdown gracefully stops the managed containers before the daemon exits
+func (c *Client) Shutdown() {
+	if c.Machine == nil {
+		return
+	}
+	err := c.Machine.StopContainers(c.Cli)
+	if err != nil {
+		log.Error("unable to stop the containers: ", err)
+	}
+}
+
 func (c *Client) actions() error {
 	var rawMessages []json.RawMessage
 	if err := c.MachineSendAndWait("actions", map[string]interface{}{}, &rawMessages); err != nil {
@@ -500,19 +909,68 @@ func (c *Client) actions() error {
 			return fmt.Errorf("failed to unmarshal action header: %w", err)
 		}
 		a.Ref = raw
-		update, actionErr := a.Process(c.Cli)
-		if actionErr != nil {
-			a.Ref = nil
-			log.Error("error processing action", a, actionErr)
-		}
-		for i := range c.Machine.Containers {
-			if c.Machine.Containers[i].Id == a.Container.Id {
-				c.Machine.Containers[i].ExpectingFirstCommit = false
-				c.Machine.Containers[i].Ports = a.Container.Ports
-				c.Machine.Containers[i].Image = a.Container.Image
-				c.Machine.Containers[i].Branch = a.Container.Branch
-				c.Machine.Containers[i].Envs = a.Container.Envs
-				c.Machine.Containers[i].Mount = a.Container.Mount
+		modifies := a.Modifies()
+		var update *proto.Msg
+		var actionErr error
+		processed := false
+		// the firewall reconciler would compare the container with its previous spec until it's recorded
+		c.Machine.Act(a.Container.Id, func() {
+			// docker only reports the first port already allocated, and only once the container is started
+			if state, ok := a.State(); ok {
+				err := c.Machine.CheckPorts(c.Cli, state)
+				if err != nil {
+					a.Ref = nil
+					actionErr = err
+					log.Error("error processing action", a, actionErr)
+					return
+				}
+			}
+			processed = true
+			update, actionErr = a.Process(c.Cli, func(update proto.Msg) {
+				err := c.ContainerSend(a.Container, update.Action, update.Params)
+				if err != nil {
+					log.Error("error reporting action progress", err)
+				}
+			})
+			if actionErr != nil {
+				a.Ref = nil
+				log.Error("error processing action", a, actionErr)
+			}
+		}, func() {
+			// a rolled back container keeps its previous spec, and the firewall that goes with it
+			var rollback *containers.RollbackError
+			if processed && modifies && !errors.As(actionErr, &rollback) {
+				c.Machine.UpdateContainer(a.Container.Id, func(container *containers.Container) {
+					container.ExpectingFirstCommit = false
+					container.Ports = a.Container.Ports
+					container.Address = a.Container.Address
+					container.Addresses = a.Container.Addresses
+					container.Image = a.Container.Image
+					container.Digest = a.Container.Digest
+					container.Branch = a.Container.Branch
+					container.Envs = a.Container.Envs
+					container.Mount = a.Container.Mount
+					container.Mounts = a.Container.Mounts
+					container.Network = a.Container.Network
+					container.Aliases = a.Container.Aliases
+					container.StopSignal = a.Container.StopSignal
+					container.StopTimeout = a.Container.StopTimeout
+					container.StopCommand = a.Container.StopCommand
+					container.Command = a.Container.Command
+					container.Args = a.Container.Args
+					container.Entrypoint = a.Container.Entrypoint
+					container.WorkingDir = a.Container.WorkingDir
+					container.Hostname = a.Container.Hostname
+					container.Registries = a.Container.Registries
+					container.Template = a.Container.Template
+					container.Variables = a.Container.Variables
+				})
+			}
+		})
+		if actionErr == nil && modifies && a.Type == action.Management {
+			err := c.reportImage(a.Container, false)
+			if err != nil {
+				log.Error("image report failed", err)
 			}
 		}
 		if update != nil {
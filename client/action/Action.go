@@ -10,6 +10,16 @@ import (
 
 const Management = "management"
 const Power = "power"
+const StackPower = "stack"
+
+// Rollback is reported when an action failed and the previous container was restored
+const Rollback = "rollback"
+
+// Progress is reported while an action is running
+const Progress = "progress"
+
+// Reporter forwards updates about a running action to the control plane
+type Reporter func(update proto.Msg)
 
 type Action struct {
 	Id        string               `json:"id"`
@@ -18,7 +28,30 @@ type Action struct {
 	Ref       json.RawMessage
 }
 
-func (a *Action) Process(cli *client.Client) (msg *proto.Msg, err error) {
+// Modifies reports whether the action changes the container, plans only compute changes
+func (a *Action) Modifies() bool {
+	if a.Type != Management {
+		return true
+	}
+	management := ManagementAction{}
+	err := json.Unmarshal(a.Ref, &management)
+	return err != nil || management.Action != Plan
+}
+
+// State returns the container a management action creates, false for the other actions and plans
+func (a *Action) State() (state containers.Container, ok bool) {
+	if a.Type != Management {
+		return state, false
+	}
+	management := ManagementAction{}
+	err := json.Unmarshal(a.Ref, &management)
+	if err != nil || management.Action == Plan {
+		return state, false
+	}
+	return management.State, true
+}
+
+func (a *Action) Process(cli *client.Client, report Reporter) (msg *proto.Msg, err error) {
 	switch a.Type {
 	case Management:
 		{
@@ -27,7 +60,21 @@ func (a *Action) Process(cli *client.Client) (msg *proto.Msg, err error) {
 			if err != nil {
 				return nil, err
 			}
-			return nil, management.Process(cli)
+			if management.Action == Plan {
+				return management.plan()
+			}
+			err = management.Process(cli, report)
+			var rollback *containers.RollbackError
+			if errors.As(err, &rollback) {
+				return &proto.Msg{
+					Action: Rollback,
+					Params: map[string]interface{}{
+						"action": a.Id,
+						"reason": rollback.Cause.Error(),
+					},
+				}, err
+			}
+			return nil, err
 		}
 	case Power:
 		{
@@ -38,6 +85,15 @@ func (a *Action) Process(cli *client.Client) (msg *proto.Msg, err error) {
 			}
 			return nil, power.Process(cli)
 		}
+	case StackPower:
+		{
+			stack := StackAction{}
+			err = json.Unmarshal(a.Ref, &stack)
+			if err != nil {
+				return nil, err
+			}
+			return nil, stack.Process(cli)
+		}
 	default:
 		return nil, errors.New("invalid action type")
 	}
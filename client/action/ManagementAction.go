@@ -3,10 +3,16 @@ package action
 import (
 	"errors"
 	"github.com/docker/docker/client"
+	"supervisor/client/proto"
 	"supervisor/containers"
 )
 
 const Update = "update"
+const Install = "install"
+const Reinstall = "reinstall"
+
+// Plan computes the firewall changes of the state without applying them
+const Plan = "plan"
 
 type ManagementAction struct {
 	Id        string               `json:"id"`
@@ -16,13 +22,34 @@ type ManagementAction struct {
 	State     containers.Container `json:"state"`
 }
 
-func (a *ManagementAction) Process(cli *client.Client) error {
+func (a *ManagementAction) Process(cli *client.Client, report Reporter) error {
 	switch a.Action {
 	case Update:
 		{
 			return a.State.Update(
 				cli,
 				false,
+				a.pullProgress(report),
+			)
+		}
+	case Install:
+		{
+			if a.State.Installed() {
+				return errors.New("the container is already installed, reinstall it instead")
+			}
+			// the container may already exist, it's stopped while the script runs like for a reinstall
+			return a.State.Reinstall(
+				cli,
+				a.installOutput(report),
+				a.pullProgress(report),
+			)
+		}
+	case Reinstall:
+		{
+			return a.State.Reinstall(
+				cli,
+				a.installOutput(report),
+				a.pullProgress(report),
 			)
 		}
 	default:
@@ -31,3 +58,42 @@ func (a *ManagementAction) Process(cli *client.Client) error {
 		}
 	}
 }
+
+// plan returns what installing the firewall of the state would change
+func (a *ManagementAction) plan() (msg *proto.Msg, err error) {
+	plans, err := a.State.PlanFirewall(a.State.Ports)
+	if err != nil {
+		return nil, err
+	}
+	return &proto.Msg{
+		Action: Plan,
+		Params: map[string]interface{}{
+			"action": a.Id,
+			"plan":   plans,
+		},
+	}, nil
+}
+
+func (a *ManagementAction) pullProgress(report Reporter) containers.ProgressFunc {
+	return func(progress containers.PullProgress) {
+		report(proto.Msg{
+			Action: Progress,
+			Params: map[string]interface{}{
+				"action": a.Id,
+				"pull":   progress,
+			},
+		})
+	}
+}
+
+func (a *ManagementAction) installOutput(report Reporter) containers.OutputFunc {
+	return func(line string) {
+		report(proto.Msg{
+			Action: Progress,
+			Params: map[string]interface{}{
+				"action":  a.Id,
+				"install": line,
+			},
+		})
+	}
+}
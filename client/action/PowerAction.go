@@ -51,5 +51,4 @@ func (a *PowerAction) Process(cli *client.Client) error {
 			return errors.New("unknown power action type")
 		}
 	}
-	return nil
 }
@@ -0,0 +1,35 @@
+package action
+
+import (
+	"errors"
+	"github.com/docker/docker/client"
+	"supervisor/containers"
+)
+
+type StackAction struct {
+	Id    string           `json:"id"`
+	Type  string           `json:"type"`
+	Stack containers.Stack `json:"stack"`
+	Power string           `json:"power"`
+}
+
+func (a *StackAction) Process(cli *client.Client) error {
+	switch a.Power {
+	case Start:
+		{
+			return a.Stack.Start(cli)
+		}
+	case Stop:
+		{
+			return a.Stack.Stop(cli)
+		}
+	case Restart:
+		{
+			return a.Stack.Restart(cli)
+		}
+	default:
+		{
+			return errors.New("unknown stack power action type")
+		}
+	}
+}
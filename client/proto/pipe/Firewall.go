@@ -0,0 +1,7 @@
+package pipe
+
+type FirewallFilter struct {
+	Container string `json:"container"`
+	Since     int64  `json:"since"`    // dropped packets logged since, unix milliseconds
+	Interval  int64  `json:"interval"` // seconds between reports, a single report when 0
+}
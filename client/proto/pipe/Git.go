@@ -1,13 +1,26 @@
 package pipe
 
 type Git struct {
-	Deployed bool `json:"deployed"`
+	Deployed   bool `json:"deployed"`
+	RolledBack bool `json:"rolledBack"`
 }
 
 type GitFilter struct {
+	Container  string `json:"container"`
+	Uri        string `json:"uri"`
+	Token      string `json:"token"`
+	Username   string `json:"username"`
+	Branch     string `json:"branch"`
+	Domain     string `json:"domain"`
+	Ssh        bool   `json:"ssh"`        // uses the deploy key of the container instead of the token
+	KnownHosts string `json:"knownHosts"` // the host keys of the server, in known_hosts format
+}
+
+type DeployKey struct {
+	PublicKey string `json:"publicKey"`
+}
+
+type DeployKeyFilter struct {
 	Container string `json:"container"`
-	Uri       string `json:"uri"`
-	Token     string `json:"token"`
-	Branch    string `json:"branch"`
-	Domain    string `json:"domain"`
+	Rotate    bool   `json:"rotate"`
 }
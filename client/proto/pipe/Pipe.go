@@ -5,10 +5,15 @@ import "context"
 type Event string
 
 const (
-	EventLog      Event = "log"
-	EventStatus   Event = "status"
-	EventPassword Event = "password"
-	EventGit      Event = "git"
+	EventLog       Event = "log"
+	EventStatus    Event = "status"
+	EventPassword  Event = "password"
+	EventGit       Event = "git"
+	EventFirewall  Event = "firewall"
+	EventDeployKey Event = "deployKey"
+	// machine events, not bound to a container
+	EventAllocate  Event = "allocate"
+	EventConflicts Event = "conflicts"
 )
 
 type GenericFilter struct {
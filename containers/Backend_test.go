@@ -0,0 +1,553 @@
+package containers
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+// inNetns moves the test into a network namespace of its own. The thread is never unlocked, so it's discarded
+// along with the namespace once the test returns
+func inNetns(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("network namespaces require root")
+	}
+	runtime.LockOSThread()
+	err := unix.Unshare(unix.CLONE_NEWNET)
+	if err != nil {
+		t.Skipf("unable to create a network namespace: %v", err)
+	}
+}
+
+// useIptables points the wrappers at the iptables and ipset binaries, the namespace has no docker so its
+// chain is created
+func useIptables(t *testing.T) {
+	t.Helper()
+	paths := make(map[string]string)
+	for _, binary := range []string{"iptables", "ip6tables", "ipset"} {
+		path, err := exec.LookPath(binary)
+		if err != nil {
+			t.Skipf("%s isn't installed", binary)
+		}
+		paths[binary] = path
+	}
+	previous := []string{ipv4Wrapper, ipv6Wrapper, ipsetWrapper}
+	ipv4Wrapper, ipv6Wrapper, ipsetWrapper = paths["iptables"], paths["ip6tables"], paths["ipset"]
+	t.Cleanup(func() {
+		ipv4Wrapper, ipv6Wrapper, ipsetWrapper = previous[0], previous[1], previous[2]
+	})
+	for _, v6 := range []bool{false, true} {
+		ipt, err := iptablesBackend{}.iptables(v6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ipt.NewChain(table, tlForward)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testRemotes returns more remotes than ipsetThreshold, so the iptables backend uses a set
+func testRemotes(v6 bool) (remotes []string) {
+	for i := 1; i <= ipsetThreshold+2; i++ {
+		if v6 {
+			remotes = append(remotes, fmt.Sprintf("2001:db8:%x::/48", i))
+		} else {
+			remotes = append(remotes, fmt.Sprintf("198.51.100.%d", i))
+		}
+	}
+	return remotes
+}
+
+func testFirewall(v6 bool) Firewall {
+	address, anywhere := "192.0.2.1", "0.0.0.0/0"
+	if v6 {
+		address, anywhere = "2001:db8::1", "::/0"
+	}
+	return Firewall{
+		Chain:     chainPrefix + "test",
+		IPv6:      v6,
+		Addresses: []string{address},
+		Ports: []Port{
+			{Port: 25565, Protocol: tcp, Policy: Drop, Remotes: testRemotes(v6)},
+			{Port: 8080, End: 8081, Policy: Accept, Remotes: []string{anywhere}},
+		},
+	}
+}
+
+// checkInstalled asserts the backend reports no drift and no change for the installed firewall
+func checkInstalled(t *testing.T, b Backend, f Firewall) {
+	t.Helper()
+	drift, err := b.Check(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift) > 0 {
+		t.Errorf("unexpected drift %v", drift)
+	}
+	plan, err := b.Plan(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Changed() {
+		t.Errorf("unexpected plan %+v", plan)
+	}
+	if len(plan.Unchanged) == 0 {
+		t.Error("no rule installed")
+	}
+}
+
+func TestIptablesBackend(t *testing.T) {
+	for _, v6 := range []bool{false, true} {
+		t.Run(fmt.Sprint("v6=", v6), func(t *testing.T) {
+			inNetns(t)
+			useIptables(t)
+			b := iptablesBackend{}
+			f := testFirewall(v6)
+			err := b.Install(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkInstalled(t, b, f)
+			ipt, err := b.iptables(v6)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for parent, chain := range map[string]string{tlForward: forward, forward: f.Chain} {
+				exists, err := ipt.Exists(table, parent, "-j", chain)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !exists {
+					t.Errorf("missing jump from %s to %s", parent, chain)
+				}
+			}
+			rules, err := ipt.List(table, f.Chain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			desired := 0
+			for i, port := range f.Ports {
+				desired += len(b.portRules(f, port, i, b.portSet(f, port)))
+			}
+			// the first line declares the chain
+			if len(rules)-1 != desired {
+				t.Errorf("listed %d rules, expected %d: %v", len(rules)-1, desired, rules)
+			}
+			set := b.portSet(f, f.Ports[0])
+			if set == "" {
+				t.Fatal("no set for the remotes of the first port")
+			}
+			members, err := ipsetMembers(set)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := ipsetEntries(f.Ports[0].remotes(v6))
+			if err != nil {
+				t.Fatal(err)
+			}
+			slices.Sort(members)
+			slices.Sort(entries)
+			if !slices.Equal(members, entries) {
+				t.Errorf("set %s holds %v, expected %v", set, members, entries)
+			}
+
+			// a reinstall without the first port drops its rules and its set
+			f.Ports = f.Ports[1:]
+			err = b.Install(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkInstalled(t, b, f)
+			if ipsetExists(set) {
+				t.Errorf("set %s wasn't destroyed", set)
+			}
+
+			err = b.Uninstall(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exists, err := ipt.ChainExists(table, f.Chain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exists {
+				t.Errorf("chain %s wasn't deleted", f.Chain)
+			}
+			sets, err := ipsetSets(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sets) > 0 {
+				t.Errorf("sets %v weren't destroyed", sets)
+			}
+			// uninstalling a firewall that was never installed creates nothing
+			err = b.Uninstall(Firewall{Chain: chainPrefix + "missing", IPv6: v6})
+			if err != nil {
+				t.Fatal(err)
+			}
+			exists, err = ipt.ChainExists(table, chainPrefix+"missing")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exists {
+				t.Error("uninstall created a chain")
+			}
+		})
+	}
+}
+
+// iptablesSnapshots makes every iptables call dump the filter table once done, and returns the function
+// reading the dumps taken since its previous call
+func iptablesSnapshots(t *testing.T) (read func() []map[string][]string) {
+	t.Helper()
+	log := filepath.Join(t.TempDir(), "snapshots")
+	script := filepath.Join(t.TempDir(), "iptables")
+	err := os.WriteFile(script, []byte(fmt.Sprintf(`#!/bin/sh
+%[1]q "$@"
+status=$?
+%[1]q -w -t %[2]s -S >> %[3]q
+echo -- >> %[3]q
+exit $status
+`, ipv4Wrapper, table, log)), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipv4Wrapper = script
+	return func() (snapshots []map[string][]string) {
+		raw, err := os.ReadFile(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(log, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshot := make(map[string][]string)
+		for _, line := range strings.Split(string(raw), "\n") {
+			fields := strings.Fields(line)
+			switch {
+			case line == "--":
+				snapshots = append(snapshots, snapshot)
+				snapshot = make(map[string][]string)
+			case len(fields) >= 2 && fields[0] == "-N":
+				snapshot[fields[1]] = make([]string, 0)
+			case len(fields) >= 2 && fields[0] == "-A":
+				snapshot[fields[1]] = append(snapshot[fields[1]], line)
+			}
+		}
+		return snapshots
+	}
+}
+
+// TestIptablesSwap checks that, whatever the step of an install, the traffic is filtered by a complete chain:
+// the first jump of the parent chain to the chain or its shadow leads to all the rules of either firewall
+func TestIptablesSwap(t *testing.T) {
+	inNetns(t)
+	useIptables(t)
+	b := iptablesBackend{}
+	previous := testFirewall(false)
+	// fewer rules than the previous firewall, so a half-filled chain never has as many rules as either
+	next := previous
+	next.Ports = previous.Ports[1:]
+	count := func(f Firewall) (rules int) {
+		for i, port := range f.Ports {
+			rules += len(b.portRules(f, port, i, b.portSet(f, port)))
+		}
+		return rules
+	}
+	complete := []int{count(previous), count(next)}
+	read := iptablesSnapshots(t)
+	check := func(step string) {
+		snapshots := read()
+		if len(snapshots) == 0 {
+			t.Fatalf("%s: no snapshot taken", step)
+		}
+		for i, snapshot := range snapshots {
+			target := ""
+			for _, rule := range snapshot[forward] {
+				for _, chain := range []string{previous.Chain, previous.Chain + shadowSuffix} {
+					if target == "" && rule == "-A "+forward+" -j "+chain {
+						target = chain
+					}
+				}
+			}
+			if target == "" {
+				t.Errorf("%s, snapshot %d: no jump to %s", step, i, previous.Chain)
+				continue
+			}
+			if rules := len(snapshot[target]); !slices.Contains(complete, rules) {
+				t.Errorf("%s, snapshot %d: %s has %d rules, expected one of %v", step, i, target, rules, complete)
+			}
+		}
+	}
+
+	err := b.Install(previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read()
+	err = b.Install(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("reinstall")
+
+	ipt, err := b.iptables(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shadow := previous.Chain + shadowSuffix
+	// an install interrupted between the insertion of the new jump and the deletion of the old one
+	err = b.Install(previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ipt.NewChain(table, shadow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, port := range next.Ports {
+		_, err = b.securePort(ipt, next, shadow, port, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ipt.Insert(table, forward, 1, "-j", shadow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read()
+	err = b.Install(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("interrupted swap")
+
+	// an install interrupted while the shadow chain was filled, before any jump to it
+	err = ipt.NewChain(table, shadow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ipt.Append(table, shadow, "-j", Drop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read()
+	err = b.Install(previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("interrupted fill")
+	checkInstalled(t, b, previous)
+}
+
+// nftRules describes the rules of a chain
+func nftRules(t *testing.T, conn *nftables.Conn, table *nftables.Table, chain string) (described []string) {
+	t.Helper()
+	rules, err := conn.GetRules(table, &nftables.Chain{Name: chain, Table: table})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range rules {
+		described = append(described, describeRule(rule))
+	}
+	return described
+}
+
+// nftElements returns the elements of a set, as ranges for interval sets
+func nftElements(t *testing.T, conn *nftables.Conn, table *nftables.Table, name string) []string {
+	t.Helper()
+	set, err := conn.GetSetByName(table, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elements, err := conn.GetSetElements(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Interval {
+		return elementRanges(elements)
+	}
+	described := make([]string, 0, len(elements))
+	for _, element := range elements {
+		address, _ := netip.AddrFromSlice(element.Key)
+		described = append(described, address.String())
+	}
+	return described
+}
+
+func expectStrings(t *testing.T, what string, got []string, expected []string) {
+	t.Helper()
+	if !slices.Equal(got, expected) {
+		t.Errorf("%s:\n got %q\nwant %q", what, got, expected)
+	}
+}
+
+func TestNftablesBackend(t *testing.T) {
+	for _, v6 := range []bool{false, true} {
+		t.Run(fmt.Sprint("v6=", v6), func(t *testing.T) {
+			inNetns(t)
+			b := nftablesBackend{}
+			f := testFirewall(v6)
+			err := b.Install(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkInstalled(t, b, f)
+			conn, done, err := b.conn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer done()
+			table, err := conn.ListTableOfFamily(nftTable, nftFamily(v6))
+			if err != nil {
+				t.Fatal(err)
+			}
+			family, remotes, anywhere := "ip", "198.51.100.1-198.51.100.10", "0.0.0.0/0"
+			if v6 {
+				family, remotes, anywhere = "ip6", "2001:db8:1::-2001:db8:a:ffff:ffff:ffff:ffff:ffff", "::/0"
+			}
+			match := func(protocol string, port string) string {
+				return fmt.Sprintf("ct direction original meta l4proto %s %s daddr @sb-test-addresses th dport %s", protocol, family, port)
+			}
+			expectStrings(t, "parent chain", nftRules(t, conn, table, nftPrerouting), []string{"jump sb-test"})
+			expectStrings(t, "chain", nftRules(t, conn, table, f.Chain), []string{
+				match("tcp", "25565") + " " + family + ` saddr @sb-test-remotes-0 counter accept comment "remote 25565/tcp"`,
+				match("tcp", "25565") + ` counter drop comment "policy 25565/tcp"`,
+				match("tcp", "8080-8081") + " " + family + ` saddr @sb-test-remotes-1 counter drop comment "remote 8080/tcp"`,
+				match("udp", "8080-8081") + " " + family + ` saddr @sb-test-remotes-1 counter drop comment "remote 8080/udp"`,
+				match("tcp", "8080-8081") + ` counter accept comment "policy 8080/tcp"`,
+				match("udp", "8080-8081") + ` counter accept comment "policy 8080/udp"`,
+			})
+			expectStrings(t, "addresses", nftElements(t, conn, table, "sb-test-addresses"), f.Addresses)
+			expectStrings(t, "remotes of 25565", nftElements(t, conn, table, "sb-test-remotes-0"), []string{remotes})
+			expectStrings(t, "remotes of 8080", nftElements(t, conn, table, "sb-test-remotes-1"), []string{anywhere})
+
+			// a reinstall without the first port drops its rules and its set
+			f.Ports = f.Ports[1:]
+			err = b.Install(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkInstalled(t, b, f)
+			expectStrings(t, "chain after reinstall", nftRules(t, conn, table, f.Chain), []string{
+				match("tcp", "8080-8081") + " " + family + ` saddr @sb-test-remotes-0 counter drop comment "remote 8080/tcp"`,
+				match("udp", "8080-8081") + " " + family + ` saddr @sb-test-remotes-0 counter drop comment "remote 8080/udp"`,
+				match("tcp", "8080-8081") + ` counter accept comment "policy 8080/tcp"`,
+				match("udp", "8080-8081") + ` counter accept comment "policy 8080/udp"`,
+			})
+			expectStrings(t, "remotes of 8080 after reinstall", nftElements(t, conn, table, "sb-test-remotes-0"), []string{anywhere})
+			_, err = conn.GetSetByName(table, "sb-test-remotes-1")
+			if err == nil {
+				t.Error("set sb-test-remotes-1 wasn't deleted")
+			}
+
+			err = b.Uninstall(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = conn.ListChain(table, f.Chain)
+			if err == nil {
+				t.Errorf("chain %s wasn't deleted", f.Chain)
+			}
+			expectStrings(t, "parent chain after uninstall", nftRules(t, conn, table, nftPrerouting), nil)
+			sets, err := conn.GetSets(table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sets) > 0 {
+				t.Errorf("%d sets weren't deleted", len(sets))
+			}
+			err = b.Uninstall(Firewall{Chain: chainPrefix + "missing", IPv6: v6})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestNftablesReplies checks every rule of a port only matches the packets of the remotes, the replies to the
+// masqueraded connections of the containers may be sent to a published port and must not hit its policy
+func TestNftablesReplies(t *testing.T) {
+	inNetns(t)
+	b := nftablesBackend{}
+	f := testFirewall(false)
+	f.Ports[0].Limits = &Limits{Rate: 10, Connections: 5}
+	err := b.Install(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, done, err := b.conn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	table, err := conn.ListTableOfFamily(nftTable, nftFamily(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := nftRules(t, conn, table, f.Chain)
+	if len(rules) != 8 {
+		t.Errorf("expected 8 rules, got %d", len(rules))
+	}
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule, "ct direction original ") {
+			t.Errorf("the rule matches replies: %s", rule)
+		}
+	}
+}
+
+// TestNftablesLogging checks the drops are logged by rules of their own, limited like the iptables ones
+func TestNftablesLogging(t *testing.T) {
+	inNetns(t)
+	t.Setenv("FIREWALL_NFLOG_GROUP", "5")
+	b := nftablesBackend{}
+	f := testFirewall(false)
+	f.Ports[0].Limits = &Limits{Rate: 10, Connections: 5}
+	err := b.Install(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkInstalled(t, b, f)
+	conn, done, err := b.conn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	table, err := conn.ListTableOfFamily(nftTable, nftFamily(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := make([]string, 0)
+	for _, rule := range nftRules(t, conn, table, f.Chain) {
+		if !strings.Contains(rule, " log ") {
+			continue
+		}
+		if strings.Contains(rule, "counter") || strings.Contains(rule, "drop") || !strings.Contains(rule, " limit rate 20/second burst 5 packets log ") {
+			t.Errorf("unexpected log rule %s", rule)
+		}
+		logged = append(logged, rule)
+	}
+	// the rate limit, the connection limit and the policy of the first port, the remotes of the second one
+	if len(logged) != 5 {
+		t.Errorf("expected 5 log rules, got %d", len(logged))
+	}
+	for _, name := range []string{"sb-test-rate-0", "sb-test-ratelog-0", "sb-test-connections-0", "sb-test-connectionslog-0"} {
+		_, err = conn.GetSetByName(table, name)
+		if err != nil {
+			t.Errorf("missing meter %s: %v", name, err)
+		}
+	}
+}
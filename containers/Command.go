@@ -0,0 +1,163 @@
+package containers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// shell operators aren't interpreted (commands are not run through a shell). They are kept as plain characters
+// of the words, as strings.Fields did, and reported so a command relying on a shell can be spotted
+const shellOperators = "|&;<>()`"
+
+// splitCommand splits a command into words following POSIX shell quoting rules, operators returns the shell
+// operators found outside of quotes. A blank command has no words, the image command is kept
+func splitCommand(command string) (args []string, operators string, err error) {
+	var word strings.Builder
+	inWord := false
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case r == '\\':
+			i++
+			if i == len(runes) {
+				return nil, "", errors.New("trailing backslash")
+			}
+			inWord = true
+			if runes[i] != '\n' {
+				word.WriteRune(runes[i])
+			}
+		case r == '\'':
+			inWord = true
+			closed := false
+			for i++; i < len(runes); i++ {
+				if runes[i] == '\'' {
+					closed = true
+					break
+				}
+				word.WriteRune(runes[i])
+			}
+			if !closed {
+				return nil, "", errors.New("unterminated single quote")
+			}
+		case r == '"':
+			inWord = true
+			closed := false
+			for i++; i < len(runes); i++ {
+				if runes[i] == '"' {
+					closed = true
+					break
+				}
+				if runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune("$`\"\\\n", runes[i+1]) {
+					i++
+					if runes[i] == '\n' {
+						continue
+					}
+				}
+				word.WriteRune(runes[i])
+			}
+			if !closed {
+				return nil, "", errors.New("unterminated double quote")
+			}
+		default:
+			inWord = true
+			word.WriteRune(r)
+			if strings.ContainsRune(shellOperators, r) && !strings.ContainsRune(operators, r) {
+				operators += string(r)
+			}
+		}
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, operators, nil
+}
+
+// parseCommand splits a command of the spec, what is the field for the errors and warnings
+func parseCommand(what string, command string) (args []string, err error) {
+	args, operators, err := splitCommand(command)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", what, err)
+	}
+	if operators != "" {
+		log.Warn(what, " ", strconv.Quote(command), " has unquoted shell operators ", strconv.Quote(operators), ", they are passed as arguments since no shell runs it")
+	}
+	return args, nil
+}
+
+// cmdArgs returns the argv that overrides the image command, explicit args take precedence
+func (c *Container) cmdArgs() (args []string, err error) {
+	if len(c.Args) > 0 {
+		return c.Args, nil
+	}
+	if c.Command == nil {
+		return nil, nil
+	}
+	return parseCommand("command", *c.Command)
+}
+
+// entrypointArgs returns the argv that overrides the image entrypoint, if any
+func (c *Container) entrypointArgs() (args []string, err error) {
+	if c.Entrypoint == nil {
+		return nil, nil
+	}
+	return parseCommand("entrypoint", *c.Entrypoint)
+}
+
+// Validate checks the spec before anything is changed on the host
+func (c *Container) Validate() (err error) {
+	_, err = c.cmdArgs()
+	if err != nil {
+		return err
+	}
+	_, err = c.entrypointArgs()
+	if err != nil {
+		return err
+	}
+	_, err = c.imageRef()
+	if err != nil {
+		return err
+	}
+	for _, address := range c.addresses() {
+		if net.ParseIP(address) == nil {
+			return fmt.Errorf("invalid address %q", address)
+		}
+	}
+	err = c.validatePorts()
+	if err != nil {
+		return err
+	}
+	err = c.validateMounts()
+	if err != nil {
+		return err
+	}
+	err = c.validateNetwork()
+	if err != nil {
+		return err
+	}
+	if c.StopTimeout != nil && *c.StopTimeout < 0 {
+		return fmt.Errorf("invalid stop timeout %d: must not be negative", *c.StopTimeout)
+	}
+	if c.WorkingDir != nil && !path.IsAbs(*c.WorkingDir) {
+		return fmt.Errorf("invalid working dir %q: must be an absolute path", *c.WorkingDir)
+	}
+	if c.Hostname != nil && (len(*c.Hostname) > 253 || !hostnamePattern.MatchString(*c.Hostname)) {
+		return fmt.Errorf("invalid hostname %q", *c.Hostname)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package containers
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		command   string
+		args      []string
+		operators string
+	}{
+		{"", nil, ""},
+		{" \t\n", nil, ""},
+		{`""`, []string{""}, ""},
+		{"java -jar server.jar", []string{"java", "-jar", "server.jar"}, ""},
+		{`java -jar "server file.jar"`, []string{"java", "-jar", "server file.jar"}, ""},
+		{`echo 'it''s' "a \"b\" \$c \d"`, []string{"echo", "its", `a "b" $c \d`}, ""},
+		{`echo 'a\b' "x"'y'z`, []string{"echo", `a\b`, "xyz"}, ""},
+		{`echo a\ b \'c\'`, []string{"echo", "a b", "'c'"}, ""},
+		{"echo a\\\nb \"c\\\nd\"", []string{"echo", "ab", "cd"}, ""},
+		{"  spaced   out  ", []string{"spaced", "out"}, ""},
+		{"curl https://example.com/?a=1&b=2", []string{"curl", "https://example.com/?a=1&b=2"}, "&"},
+		{"run | tee log; done && exit", []string{"run", "|", "tee", "log;", "done", "&&", "exit"}, "|;&"},
+		{`echo "a|b" 'c;d' e\&f`, []string{"echo", "a|b", "c;d", "e&f"}, ""},
+	}
+	for _, test := range tests {
+		args, operators, err := splitCommand(test.command)
+		if err != nil {
+			t.Errorf("%q: %v", test.command, err)
+			continue
+		}
+		if !slices.Equal(args, test.args) {
+			t.Errorf("%q: got %q, expected %q", test.command, args, test.args)
+		}
+		if operators != test.operators {
+			t.Errorf("%q: got operators %q, expected %q", test.command, operators, test.operators)
+		}
+	}
+
+	for command, expected := range map[string]string{
+		`echo \`:             "trailing backslash",
+		`echo 'unterminated`: "unterminated single quote",
+		`echo "unterminated`: "unterminated double quote",
+		`echo "a\"`:          "unterminated double quote",
+	} {
+		_, _, err := splitCommand(command)
+		if err == nil || err.Error() != expected {
+			t.Errorf("%q: expected %q, got %v", command, expected, err)
+		}
+	}
+}
+
+func TestQuoteArgs(t *testing.T) {
+	for _, args := range [][]string{
+		{"java", "-jar", "server file.jar"},
+		{"sh", "-c", `echo "it's" $HOME | tee log`},
+		{"", "a\\b", "new\nline"},
+	} {
+		parsed, operators, err := splitCommand(quoteArgs(args))
+		if err != nil {
+			t.Errorf("%q: %v", args, err)
+			continue
+		}
+		if !slices.Equal(parsed, args) {
+			t.Errorf("%q: parsed back as %q", args, parsed)
+		}
+		if operators != "" {
+			t.Errorf("%q: quoted operators reported %q", args, operators)
+		}
+	}
+}
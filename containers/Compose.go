@@ -0,0 +1,313 @@
+package containers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// the longest id accepted by useradd
+const maxIdLength = 32
+
+var serviceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// composeFile is the supported subset of the docker-compose format, unknown keys are rejected instead
+// of being silently ignored
+type composeFile struct {
+	Version  interface{}               `yaml:"version"`
+	Services map[string]composeService `yaml:"services"`
+	Volumes  interface{}               `yaml:"volumes"`  // volumes are always private to their container
+	Networks interface{}               `yaml:"networks"` // every service joins the stack network
+}
+
+type composeService struct {
+	Image           string      `yaml:"image"`
+	Command         composeArgs `yaml:"command"`
+	Entrypoint      composeArgs `yaml:"entrypoint"`
+	Environment     composeEnv  `yaml:"environment"`
+	Ports           []string    `yaml:"ports"`
+	DependsOn       composeDeps `yaml:"depends_on"`
+	Volumes         []string    `yaml:"volumes"`
+	WorkingDir      string      `yaml:"working_dir"`
+	Hostname        string      `yaml:"hostname"`
+	StopSignal      string      `yaml:"stop_signal"`
+	StopGracePeriod string      `yaml:"stop_grace_period"`
+	MemLimit        string      `yaml:"mem_limit"`
+	Restart         interface{} `yaml:"restart"`  // containers always restart unless stopped
+	Networks        interface{} `yaml:"networks"` // every service joins the stack network
+}
+
+// composeArgs is either a command string or an argv list
+type composeArgs struct {
+	Command *string
+	Args    []string
+}
+
+func (a *composeArgs) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		a.Command = &value.Value
+		return nil
+	}
+	return value.Decode(&a.Args)
+}
+
+// composeEnv is either a map or a list of KEY=VALUE
+type composeEnv map[string]string
+
+func (e *composeEnv) UnmarshalYAML(value *yaml.Node) error {
+	*e = make(composeEnv)
+	if value.Kind == yaml.MappingNode {
+		return value.Decode((*map[string]string)(e))
+	}
+	var list []string
+	err := value.Decode(&list)
+	if err != nil {
+		return err
+	}
+	for _, entry := range list {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 2 {
+			(*e)[parts[0]] = parts[1]
+		} else {
+			(*e)[parts[0]] = ""
+		}
+	}
+	return nil
+}
+
+// composeDeps is either a list of services or a map of services to conditions (which are ignored)
+type composeDeps []string
+
+func (d *composeDeps) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.MappingNode {
+		var conditions map[string]interface{}
+		err := value.Decode(&conditions)
+		if err != nil {
+			return err
+		}
+		for service := range conditions {
+			*d = append(*d, service)
+		}
+		sort.Strings(*d)
+		return nil
+	}
+	return value.Decode((*[]string)(d))
+}
+
+// quoteArgs joins an argv into a command that splitCommand parses back into the same argv
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// parseBytes parses compose byte values, e.g. 512m or 1g
+func parseBytes(value string) (size int64, err error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	multiplier := int64(1)
+	units := map[string]int64{"b": 1, "k": 1 << 10, "kb": 1 << 10, "m": 1 << 20, "mb": 1 << 20, "g": 1 << 30, "gb": 1 << 30}
+	for _, suffix := range []string{"kb", "mb", "gb", "b", "k", "m", "g"} {
+		if strings.HasSuffix(value, suffix) {
+			multiplier = units[suffix]
+			value = strings.TrimSuffix(value, suffix)
+			break
+		}
+	}
+	size, err = strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return size * multiplier, nil
+}
+
+// parseRange parses a compose port or port range, e.g. 27015 or 27015-27030
+func parseRange(value string) (first int, last int, err error) {
+	bounds := strings.SplitN(value, "-", 2)
+	first, err = strconv.Atoi(bounds[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	last = first
+	if len(bounds) == 2 {
+		last, err = strconv.Atoi(bounds[1])
+	}
+	return first, last, err
+}
+
+// translatePort translates the short port syntax: [host[-end]:]container[-end][/protocol]
+func translatePort(spec string) (port Port, err error) {
+	port = Port{
+		Policy: Accept,
+	}
+	mapping := spec
+	if parts := strings.SplitN(spec, "/", 2); len(parts) == 2 {
+		mapping = parts[0]
+		port.Protocol = parts[1]
+	}
+	parts := strings.Split(mapping, ":")
+	if len(parts) > 2 {
+		return port, fmt.Errorf("unsupported port %q: the host address is set by the stack", spec)
+	}
+	targetFirst, targetLast, err := parseRange(parts[len(parts)-1])
+	if err != nil {
+		return port, fmt.Errorf("invalid port %q", spec)
+	}
+	hostFirst, hostLast := targetFirst, targetLast
+	if len(parts) == 2 {
+		hostFirst, hostLast, err = parseRange(parts[0])
+		if err != nil {
+			return port, fmt.Errorf("invalid port %q", spec)
+		}
+	}
+	if hostLast-hostFirst != targetLast-targetFirst {
+		return port, fmt.Errorf("invalid port %q: host and container ranges differ in size", spec)
+	}
+	port.Port = hostFirst
+	if hostLast != hostFirst {
+		port.End = hostLast
+	}
+	if targetFirst != hostFirst {
+		port.Target = targetFirst
+	}
+	return port, port.validate()
+}
+
+// translateVolume translates the short volume syntax, relative sources are binds within the container directory
+func translateVolume(spec string) (m MountSpec, err error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return m, fmt.Errorf("unsupported volume %q: source and target are required", spec)
+	}
+	m = MountSpec{
+		Type:   MountVolume,
+		Source: parts[0],
+		Target: parts[1],
+	}
+	if strings.HasPrefix(parts[0], ".") || strings.HasPrefix(parts[0], "/") {
+		m.Type = MountBind
+	}
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			m.ReadOnly = true
+		case "rw":
+		default:
+			return m, fmt.Errorf("unsupported volume mode %q", parts[2])
+		}
+	}
+	return m, nil
+}
+
+func (s *Stack) translateService(name string, service composeService) (member Container, err error) {
+	if !serviceNamePattern.MatchString(name) {
+		return member, fmt.Errorf("invalid service name %q", name)
+	}
+	id := s.Id + "-" + name
+	if len(id) > maxIdLength {
+		return member, fmt.Errorf("service name %q is too long for stack %s", name, s.Id)
+	}
+	if service.Image == "" {
+		return member, fmt.Errorf("service %s has no image", name)
+	}
+	member = Container{
+		Id:           id,
+		Image:        service.Image,
+		Address:      s.Address,
+		Addresses:    s.Addresses,
+		Mount:        s.Mount,
+		Label:        s.Label,
+		Envs:         service.Environment,
+		Ports:        make([]Port, 0),
+		Aliases:      []string{name},
+		Command:      service.Command.Command,
+		Args:         service.Command.Args,
+		Replacements: s.Replacements,
+	}
+	if service.Entrypoint.Command != nil {
+		member.Entrypoint = service.Entrypoint.Command
+	} else if len(service.Entrypoint.Args) > 0 {
+		entrypoint := quoteArgs(service.Entrypoint.Args)
+		member.Entrypoint = &entrypoint
+	}
+	for _, dependency := range service.DependsOn {
+		member.DependsOn = append(member.DependsOn, s.Id+"-"+dependency)
+	}
+	for _, spec := range service.Ports {
+		port, err := translatePort(spec)
+		if err != nil {
+			return member, err
+		}
+		member.Ports = append(member.Ports, port)
+	}
+	for _, spec := range service.Volumes {
+		m, err := translateVolume(spec)
+		if err != nil {
+			return member, err
+		}
+		member.Mounts = append(member.Mounts, m)
+	}
+	if service.WorkingDir != "" {
+		member.WorkingDir = &service.WorkingDir
+	}
+	if service.Hostname != "" {
+		member.Hostname = &service.Hostname
+	}
+	if service.StopSignal != "" {
+		member.StopSignal = &service.StopSignal
+	}
+	if service.StopGracePeriod != "" {
+		period, err := time.ParseDuration(service.StopGracePeriod)
+		if err != nil {
+			return member, fmt.Errorf("invalid stop_grace_period %q", service.StopGracePeriod)
+		}
+		seconds := int(period.Seconds())
+		member.StopTimeout = &seconds
+	}
+	if service.MemLimit != "" {
+		memory, err := parseBytes(service.MemLimit)
+		if err != nil {
+			return member, fmt.Errorf("invalid mem_limit %q", service.MemLimit)
+		}
+		member.Memory = &memory
+	}
+	return member, nil
+}
+
+// translateCompose translates a docker-compose file into the stack containers, one per service
+func (s *Stack) translateCompose(raw string) (members []Container, err error) {
+	if s.Mount == "" {
+		return nil, errors.New("stacks translated from compose require a mount")
+	}
+	file := composeFile{}
+	decoder := yaml.NewDecoder(bytes.NewReader([]byte(raw)))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&file)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Services) == 0 {
+		return nil, errors.New("no services")
+	}
+	names := make([]string, 0, len(file.Services))
+	for name := range file.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		member, err := s.translateService(name, file.Services[name])
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
@@ -0,0 +1,265 @@
+package containers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+// Config formats
+const (
+	ConfigProperties = "properties" // key=value lines, missing keys are appended
+	ConfigJson       = "json"       // dotted keys, missing keys are created
+	ConfigYaml       = "yaml"       // dotted keys, missing keys are created, comments are kept
+	ConfigLines      = "lines"      // keys are line prefixes, matching lines are replaced by the value
+)
+
+// ConfigRewrite sets values in a config file of the application, values may contain ${VAR} placeholders
+type ConfigRewrite struct {
+	Path   string            `json:"path"` // relative to the container directory
+	Format string            `json:"format"`
+	Values map[string]string `json:"values"`
+}
+
+func (r ConfigRewrite) validate() error {
+	relative := filepath.Clean(r.Path)
+	if filepath.IsAbs(relative) || escapes(relative) {
+		return fmt.Errorf("invalid config path %q: must be relative to the container directory", r.Path)
+	}
+	switch r.Format {
+	case ConfigProperties, ConfigJson, ConfigYaml, ConfigLines:
+		return nil
+	default:
+		return fmt.Errorf("invalid config format %q for %s", r.Format, r.Path)
+	}
+}
+
+// sortedKeys keeps the rewrites (and appended keys) stable between runs
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// openBeneath opens a file of a tenant tree without following symlinks out of root, the checks are done by
+// the kernel while resolving, so the tenant can't swap a component for a symlink between a check and the open
+func openBeneath(root string, relative string, flag int) (file *os.File, err error) {
+	dir, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(dir)
+	path := filepath.Join(root, relative)
+	fd, err := unix.Openat2(dir, relative, &unix.OpenHow{
+		Flags:   uint64(flag | unix.O_NOFOLLOW | unix.O_CLOEXEC),
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	file = os.NewFile(uintptr(fd), path)
+	var stat unix.Stat_t
+	err = unix.Fstat(fd, &stat)
+	if err == nil && (stat.Mode&unix.S_IFMT != unix.S_IFREG || stat.Nlink != 1) {
+		err = errors.New("not a regular file with a single link")
+	}
+	if err != nil {
+		file.Close()
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return file, nil
+}
+
+func (c *Container) rewriteConfig(r ConfigRewrite, variables map[string]string) (err error) {
+	// the file belongs to the tenant, it may be replaced by a symlink pointing anywhere at any time
+	file, err := openBeneath(c.Dir(), filepath.Clean(r.Path), os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	substitutions := mergeValues(variables, c.Replacements)
+	values := make(map[string]string, len(r.Values))
+	for key, value := range r.Values {
+		values[key] = substitute(value, substitutions)
+	}
+	var rewritten []byte
+	switch r.Format {
+	case ConfigProperties:
+		rewritten = rewriteProperties(content, values)
+	case ConfigLines:
+		rewritten = rewriteLines(content, values)
+	case ConfigJson:
+		rewritten, err = rewriteJson(content, values)
+	case ConfigYaml:
+		rewritten, err = rewriteYaml(content, values)
+	}
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(content, rewritten) {
+		return nil
+	}
+	log.Info("rewriting config ", r.Path)
+	// written in place through the same descriptor, the owner and mode of the file are kept
+	err = file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt(rewritten, 0)
+	return err
+}
+
+func rewriteProperties(content []byte, values map[string]string) []byte {
+	var out bytes.Buffer
+	set := make(map[string]struct{})
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") && !strings.HasPrefix(trimmed, "!") {
+			key := strings.TrimSpace(strings.SplitN(strings.SplitN(trimmed, "=", 2)[0], ":", 2)[0])
+			if value, ok := values[key]; ok {
+				line = key + "=" + value
+				set[key] = struct{}{}
+			}
+		}
+		out.WriteString(line + "\n")
+	}
+	for _, key := range sortedKeys(values) {
+		if _, ok := set[key]; !ok {
+			out.WriteString(key + "=" + values[key] + "\n")
+		}
+	}
+	return out.Bytes()
+}
+
+func rewriteLines(content []byte, values map[string]string) []byte {
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		for _, prefix := range sortedKeys(values) {
+			if strings.HasPrefix(line, prefix) {
+				line = values[prefix]
+				break
+			}
+		}
+		out.WriteString(line + "\n")
+	}
+	return out.Bytes()
+}
+
+// jsonValue keeps numbers, booleans and null typed, anything else is a string
+func jsonValue(value string) (typed interface{}) {
+	err := json.Unmarshal([]byte(value), &typed)
+	if err != nil {
+		return value
+	}
+	if _, isObject := typed.(map[string]interface{}); isObject {
+		return value
+	}
+	if _, isArray := typed.([]interface{}); isArray {
+		return value
+	}
+	return typed
+}
+
+func rewriteJson(content []byte, values map[string]string) ([]byte, error) {
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	err := decoder.Decode(&document)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range sortedKeys(values) {
+		path := strings.Split(key, ".")
+		object, ok := document.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("can't set %s: not an object", key)
+		}
+		for _, segment := range path[:len(path)-1] {
+			child, ok := object[segment].(map[string]interface{})
+			if !ok {
+				if _, exists := object[segment]; exists {
+					return nil, fmt.Errorf("can't set %s: %s is not an object", key, segment)
+				}
+				child = make(map[string]interface{})
+				object[segment] = child
+			}
+			object = child
+		}
+		object[path[len(path)-1]] = jsonValue(values[key])
+	}
+	rewritten, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(rewritten, '\n'), nil
+}
+
+// yamlChild returns the value node of a mapping key, creating it when missing
+func yamlChild(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	value := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+	return value
+}
+
+func rewriteYaml(content []byte, values map[string]string) ([]byte, error) {
+	var document yaml.Node
+	err := yaml.Unmarshal(content, &document)
+	if err != nil {
+		return nil, err
+	}
+	if document.Kind == 0 {
+		document = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	for _, key := range sortedKeys(values) {
+		node := document.Content[0]
+		for _, segment := range strings.Split(key, ".") {
+			if node.Kind != yaml.MappingNode {
+				return nil, fmt.Errorf("can't set %s: %s is not a mapping", key, segment)
+			}
+			node = yamlChild(node, segment)
+		}
+		// the tag is resolved from the value, like when it's written by hand
+		var scalar yaml.Node
+		err = yaml.Unmarshal([]byte(values[key]), &scalar)
+		if err != nil || len(scalar.Content) != 1 || scalar.Content[0].Kind != yaml.ScalarNode {
+			node.Kind, node.Tag, node.Value, node.Style, node.Content = yaml.ScalarNode, "!!str", values[key], 0, nil
+			continue
+		}
+		node.Kind, node.Tag, node.Value, node.Style, node.Content = yaml.ScalarNode, scalar.Content[0].Tag, values[key], 0, nil
+	}
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	err = encoder.Encode(&document)
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), encoder.Close()
+}
@@ -0,0 +1,56 @@
+package containers
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenBeneath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	secret := filepath.Join(outside, "secret")
+	err := os.WriteFile(secret, []byte("secret"), 0600)
+	if err == nil {
+		err = os.MkdirAll(filepath.Join(root, "config"), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(root, "config", "server.properties"), []byte("port=1"), 0644)
+	}
+	if err == nil {
+		err = os.Symlink(secret, filepath.Join(root, "absolute"))
+	}
+	if err == nil {
+		err = os.Symlink("../../"+filepath.Base(outside)+"/secret", filepath.Join(root, "config", "relative"))
+	}
+	if err == nil {
+		err = os.Symlink(outside, filepath.Join(root, "dir"))
+	}
+	if err == nil {
+		err = os.Symlink("config/server.properties", filepath.Join(root, "inside"))
+	}
+	if err == nil {
+		err = os.Link(secret, filepath.Join(root, "hardlink"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := openBeneath(root, "config/server.properties", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(file)
+	file.Close()
+	if err != nil || string(content) != "port=1" {
+		t.Errorf("read %q, %v", content, err)
+	}
+	for _, path := range []string{"absolute", "config/relative", "dir/secret", "inside", "hardlink", "../" + filepath.Base(outside) + "/secret", "config"} {
+		file, err := openBeneath(root, path, os.O_RDWR)
+		if err == nil {
+			file.Close()
+			t.Errorf("%s was opened", path)
+		}
+	}
+}
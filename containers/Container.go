@@ -5,9 +5,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 	"supervisor/client/proto/pipe"
 	"supervisor/machine/hardware"
@@ -16,7 +17,6 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
-	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
@@ -26,19 +26,39 @@ import (
 
 var unknownContainer = errors.New("unknown container")
 
+// defaultStopTimeout matches the docker default used when no stop timeout is provided
+const defaultStopTimeout = 10 * time.Second
+
 type Container struct {
 	Id                   string            `json:"id"`
 	Image                string            `json:"image"`
+	Digest               *string           `json:"digest"` // pins the image to a digest
 	Address              string            `json:"address"`
+	Addresses            []string          `json:"addresses"` // additional addresses, e.g. the IPv6 one
 	Mount                string            `json:"mount"`
+	Mounts               []MountSpec       `json:"mounts"` // additional mounts
 	Envs                 map[string]string `json:"envs"`
 	Ports                []Port            `json:"ports"`
 	Branch               *string           `json:"branch"`
+	Network              *string           `json:"network"` // containers of the same group share a private network
+	Aliases              []string          `json:"aliases"` // names the container is reachable by on its network
 	Command              *string           `json:"command"`
+	Args                 []string          `json:"args"` // explicit argv, takes precedence over command
+	Entrypoint           *string           `json:"entrypoint"`
+	WorkingDir           *string           `json:"workingDir"`
+	Hostname             *string           `json:"hostname"`
 	Memory               *int64            `json:"memory"`
+	StopSignal           *string           `json:"stopSignal"`
+	StopTimeout          *int              `json:"stopTimeout"` // seconds
+	StopCommand          *string           `json:"stopCommand"`
 	Label                Label             `json:"label"`
+	Stack                *string           `json:"stack"`     // set on the members of a stack
+	DependsOn            []string          `json:"dependsOn"` // stack members started before this one
 	ExpectingFirstCommit bool
-	Replacements         map[string]string `json:"replacements"`
+	Replacements         map[string]string     `json:"replacements"`
+	Registries           []RegistryCredentials `json:"registries"`
+	Template             *Template             `json:"template"`
+	Variables            map[string]string     `json:"variables"` // values of the template variables
 }
 
 type Label string
@@ -246,11 +266,26 @@ func (c *Container) Create(cli *client.Client) (err error) {
 	if err != nil {
 		return err
 	}
-	return c.Update(cli, true)
+	if c.Template != nil && c.Template.Install != nil && !c.Installed() {
+		err = c.Install(cli, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return c.Update(cli, true, nil)
 }
 
-// Update applies the new firewall rules and creates (or updates) the container
-func (c *Container) Update(cli *client.Client, firstUpdate bool) (err error) {
+// Update creates (or updates) the container and applies the new firewall rules once it's swapped in, a rolled
+// back update keeps the firewall of the previous container. report receives the image pull progress and may be nil
+func (c *Container) Update(cli *client.Client, firstUpdate bool, report ProgressFunc) (err error) {
+	err = c.applyTemplate()
+	if err != nil {
+		return err
+	}
+	err = c.Validate()
+	if err != nil {
+		return err
+	}
 	status, statusErr := c.getStatus(cli, nil, nil)
 	shouldRestart := !(firstUpdate && c.Branch != nil)
 	if shouldRestart && statusErr == nil {
@@ -258,35 +293,75 @@ func (c *Container) Update(cli *client.Client, firstUpdate bool) (err error) {
 			shouldRestart = false
 		}
 	}
-	err = c.pullImage(cli)
+	err = c.pullImage(cli, report)
 	if err != nil {
 		return err
 	}
-	err = c.createContainer(cli)
-	if err != nil {
-		return err
+	// checked before the container is replaced, the firewall can't be installed afterwards otherwise
+	if os.Getenv("SKIP_IPTABLES") != "true" {
+		err = requireGeoIP(c.Ports)
+		if err != nil {
+			return err
+		}
 	}
-	err = c.InstallFirewall()
+	err = c.rewriteConfigs()
 	if err != nil {
 		return err
 	}
 	log.Info("first update: ", firstUpdate, ", branch: ", c.Branch)
-	if shouldRestart {
-		return c.Start(cli)
+	err = c.createContainer(cli, shouldRestart)
+	if err != nil {
+		return err
 	}
-	return nil
+	return c.InstallFirewall()
 }
 
 func (c *Container) InstallFirewall() (err error) {
 	if os.Getenv("SKIP_IPTABLES") == "true" {
 		return nil
 	}
-	firewall, err := c.firewall(c.Ports)
+	// the installed rules are kept
+	err = requireGeoIP(c.Ports)
 	if err != nil {
 		return err
 	}
-	err = firewall.Install()
-	return err
+	firewalls, err := c.firewalls(c.Ports)
+	if err != nil {
+		return err
+	}
+	for _, firewall := range firewalls {
+		err = firewall.Install()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addresses returns every host address the ports are published on
+func (c *Container) addresses() []string {
+	addresses := make([]string, 0, len(c.Addresses)+1)
+	if c.Address != "" {
+		addresses = append(addresses, c.Address)
+	}
+	for _, address := range c.Addresses {
+		if !slices.Contains(addresses, address) {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// environment returns the container env, the env files overridden by the spec envs, with the replacements applied
+func (c *Container) environment() (env []string) {
+	envMap, _ := c.LoadEnvMap(c.Dir())
+	for k, v := range c.Envs {
+		envMap[k] = v
+	}
+	for k, v := range envMap {
+		env = append(env, fmt.Sprintf("%s=%s", k, substitute(v, c.Replacements)))
+	}
+	return env
 }
 
 func (c *Container) LoadEnvMap(hostPath string) (map[string]string, error) {
@@ -311,102 +386,132 @@ func (c *Container) LoadEnvMap(hostPath string) (map[string]string, error) {
 	return make(map[string]string), nil
 }
 
-func (c *Container) pullImage(cli *client.Client) (err error) {
-	log.Info("pulling image")
-	out, err := cli.ImagePull(context.Background(), c.Image, image.PullOptions{})
+// createContainer creates the container under a temporary name and only swaps it in once creation
+// succeeded, the previous container is restored if the swap (or the start, when requested) fails
+func (c *Container) createContainer(cli *client.Client, start bool) (err error) {
+	// the spec is fully resolved before the existing container is touched
+	config, hostConfig, err := c.containerConfig(cli)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
-
-	// Stream output to the console
-	_, err = io.Copy(os.Stdout, out)
+	ctx := context.Background()
+	err = c.recoverSwap(ctx, cli)
 	if err != nil {
-		return fmt.Errorf("error reading image pull stream: %w", err)
-	}
-	return nil
-}
-
-func (c *Container) createContainer(cli *client.Client) (err error) {
-	_, fetchErr := c.cId(cli)
-	if fetchErr == nil {
-		err = c.Stop(cli)
-		if err != nil {
-			return err
-		}
-		err = c.deleteContainer(cli)
-		if err != nil {
-			return err
-		}
+		return err
 	}
 	log.Info("creating container")
-	containerPath := c.Dir()
-	envMap, _ := c.LoadEnvMap(containerPath)
-	for k, v := range c.Envs {
-		envMap[k] = v
+	networkLock.Lock()
+	err = c.ensureNetwork(cli)
+	if err != nil {
+		networkLock.Unlock()
+		return err
 	}
-	var env []string
-	for k, v := range envMap {
-		finalV := v
-		// Iterate through the replacements map and apply them
-		for varK, varV := range c.Replacements {
-			// Construct the placeholder string to replace, e.g., "${VARIABLE_NAME}"
-			placeholderA := fmt.Sprintf("${%s}", varK)
-			placeholderB := fmt.Sprintf("VAR_%s", varK)
-			finalV = strings.ReplaceAll(finalV, placeholderA, varV)
-			finalV = strings.ReplaceAll(finalV, placeholderB, varV)
+	next, err := cli.ContainerCreate(ctx, config, hostConfig, c.networkingConfig(), nil, c.cName()+nextSuffix)
+	networkLock.Unlock()
+	if err != nil {
+		// the previous container (if any) hasn't been touched
+		return err
+	}
+	previous, err := c.cId(cli)
+	if errors.Is(err, unknownContainer) {
+		err = cli.ContainerRename(ctx, next.ID, c.cName())
+		if err == nil && start {
+			err = cli.ContainerStart(ctx, next.ID, container.StartOptions{})
 		}
-		env = append(env, fmt.Sprintf("%s=%s", k, finalV))
+		return err
 	}
-	hostPath, err := c.HostDir(cli)
 	if err != nil {
+		_ = cli.ContainerRemove(ctx, next.ID, container.RemoveOptions{Force: true})
 		return err
 	}
+	return c.swapContainer(ctx, cli, previous, next.ID, start)
+}
+
+func (c *Container) containerConfig(cli *client.Client) (config *container.Config, hostConfig *container.HostConfig, err error) {
+	err = c.applyTemplate()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = c.Validate()
+	if err != nil {
+		return nil, nil, err
+	}
+	env := c.environment()
+	hostPath, err := c.HostDir(cli)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	portBindings := nat.PortMap{}
 	exposedPorts := nat.PortSet{}
 
 	for _, p := range c.Ports {
-		for _, proto := range protocols {
-			portStr := fmt.Sprintf("%d/%s", p.Port, proto)
-			natPort := nat.Port(portStr)
-			exposedPorts[natPort] = struct{}{}
-			portBindings[natPort] = []nat.PortBinding{
-				{
-					HostIP:   c.Address,
-					HostPort: fmt.Sprintf("%d", p.Port),
-				},
+		for _, proto := range p.protocols() {
+			for hostPort := p.Port; hostPort <= p.last(); hostPort++ {
+				natPort := nat.Port(fmt.Sprintf("%d/%s", p.target(hostPort), proto))
+				exposedPorts[natPort] = struct{}{}
+				for _, address := range c.addresses() {
+					portBindings[natPort] = append(portBindings[natPort], nat.PortBinding{
+						HostIP:   address,
+						HostPort: fmt.Sprintf("%d", hostPort),
+					})
+				}
 			}
 		}
 	}
 
 	err, perm := c.PermSnippet()
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	cmdArgs, err := c.cmdArgs()
+	if err != nil {
+		return nil, nil, err
+	}
+	entrypoint, err := c.entrypointArgs()
+	if err != nil {
+		return nil, nil, err
 	}
-	var cmdArgs []string
-	if c.Command != nil {
-		cmdArgs = strings.Fields(*c.Command)
-	} else {
-		// cmdArgs = nil or leave empty
-		cmdArgs = nil
+	ref, err := c.imageRef()
+	if err != nil {
+		return nil, nil, err
 	}
-	config := &container.Config{
-		Image:        c.Image,
+	config = &container.Config{
+		Image:        ref,
+		Labels:       c.labels(cli, ref),
 		ExposedPorts: exposedPorts,
 		Env:          env,
 		User:         perm,
 		Cmd:          cmdArgs,
+		Entrypoint:   entrypoint,
+		StopTimeout:  c.StopTimeout,
+		// stdin is kept open so the pre-stop command can be written to the console
+		OpenStdin: c.StopCommand != nil,
+	}
+	if c.StopSignal != nil {
+		config.StopSignal = *c.StopSignal
+	}
+	if c.WorkingDir != nil {
+		config.WorkingDir = *c.WorkingDir
+	}
+	if c.Hostname != nil {
+		config.Hostname = *c.Hostname
 	}
-	hostConfig := &container.HostConfig{
+	mounts, err := c.extraMounts(*hostPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	hostConfig = &container.HostConfig{
 		PortBindings: portBindings,
-		Mounts: []mount.Mount{
+		NetworkMode:  container.NetworkMode(c.networkName()),
+		// the container directory is always the first mount
+		Mounts: append([]mount.Mount{
 			{
 				Type:   mount.TypeBind,
 				Source: *hostPath,
 				Target: c.Mount,
 			},
-		},
+		}, mounts...),
 		RestartPolicy: container.RestartPolicy{
 			Name: container.RestartPolicyUnlessStopped,
 		},
@@ -414,11 +519,25 @@ func (c *Container) createContainer(cli *client.Client) (err error) {
 	if c.Memory != nil && *c.Memory > 0 {
 		hostConfig.Memory = *c.Memory
 	}
-	_, err = cli.ContainerCreate(context.Background(), config, hostConfig, nil, nil, c.cName())
-	if err != nil {
-		return err
+	return config, hostConfig, nil
+}
+
+func (c *Container) labels(cli *client.Client, ref string) map[string]string {
+	labels := c.digestLabels(cli, ref)
+	if c.Stack != nil {
+		labels[stackLabel] = *c.Stack
+		labels[specLabel] = c.specHash()
 	}
-	return err
+	return labels
+}
+
+// StackOf returns the stack recorded on a docker container, if any
+func StackOf(labels map[string]string) *string {
+	stack, ok := labels[stackLabel]
+	if !ok {
+		return nil
+	}
+	return &stack
 }
 
 func (c *Container) Start(cli *client.Client) (err error) {
@@ -438,7 +557,7 @@ func (c *Container) Stop(cli *client.Client) (err error) {
 	if err != nil {
 		return err
 	}
-	return cli.ContainerStop(ctx, cid, container.StopOptions{})
+	return c.stop(ctx, cli, cid)
 }
 
 func (c *Container) Restart(cli *client.Client) (err error) {
@@ -448,7 +567,114 @@ func (c *Container) Restart(cli *client.Client) (err error) {
 	if err != nil {
 		return err
 	}
-	return cli.ContainerRestart(ctx, cid, container.StopOptions{})
+	if c.StopCommand == nil {
+		return cli.ContainerRestart(ctx, cid, c.stopOptions(nil))
+	}
+	// the pre-stop command can't be sent by docker itself, so restart is split in two
+	err = c.stop(ctx, cli, cid)
+	if err != nil {
+		return err
+	}
+	return cli.ContainerStart(ctx, cid, container.StartOptions{})
+}
+
+// stopTimeout returns the time the container gets to stop, Validate rejects negative timeouts but containers
+// read back from docker aren't validated
+func (c *Container) stopTimeout() time.Duration {
+	if c.StopTimeout == nil || *c.StopTimeout < 0 {
+		return defaultStopTimeout
+	}
+	return time.Duration(*c.StopTimeout) * time.Second
+}
+
+// stopOptions returns the stop signal and the time docker waits before killing the container, the stop
+// timeout when timeout is nil
+func (c *Container) stopOptions(timeout *int) container.StopOptions {
+	seconds := int(c.stopTimeout().Seconds())
+	options := container.StopOptions{
+		Timeout: &seconds,
+	}
+	if timeout != nil {
+		options.Timeout = timeout
+	}
+	if c.StopSignal != nil {
+		options.Signal = *c.StopSignal
+	}
+	return options
+}
+
+// stop gracefully stops the container: the pre-stop command is sent first (if any), and the
+// stop signal is only delivered if the container didn't exit on its own within the stop timeout.
+// docker is always asked to stop it, even once exited, otherwise the restart policy starts it again
+func (c *Container) stop(ctx context.Context, cli *client.Client, cid string) (err error) {
+	var remaining *int
+	if c.StopCommand != nil && *c.StopCommand != "" {
+		status, statusErr := c.getStatus(cli, &ctx, &cid)
+		if statusErr == nil && status == "running" {
+			started := time.Now()
+			exited, err := c.sendStopCommand(ctx, cli, cid)
+			if err != nil {
+				log.Error("error while sending stop command: ", err)
+			} else if exited {
+				log.Info("container exited after stop command")
+			}
+			// the stop command used part of the timeout, the signal only gets what's left of it
+			seconds := max(0, int((c.stopTimeout() - time.Since(started)).Seconds()))
+			remaining = &seconds
+		}
+	}
+	return cli.ContainerStop(ctx, cid, c.stopOptions(remaining))
+}
+
+// sendStopCommand writes the pre-stop command to the container console and waits for it to exit
+func (c *Container) sendStopCommand(ctx context.Context, cli *client.Client, cid string) (exited bool, err error) {
+	log.Info("sending stop command")
+	inspect, err := cli.ContainerInspect(ctx, cid)
+	if err != nil {
+		return false, err
+	}
+	if !inspect.Config.OpenStdin {
+		// created before the stop command was set, the console can't be written to until it's updated
+		return false, errors.New("the container has no stdin, it must be updated to receive the stop command")
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, c.stopTimeout())
+	defer cancel()
+	// wait is registered before writing the command so a fast exit isn't missed
+	waitChan, errChan := cli.ContainerWait(waitCtx, cid, container.WaitConditionNotRunning)
+	attach, err := cli.ContainerAttach(ctx, cid, container.AttachOptions{
+		Stream: true,
+		Stdin:  true,
+	})
+	if err != nil {
+		return false, err
+	}
+	_, err = attach.Conn.Write([]byte(*c.StopCommand + "\n"))
+	attach.Close()
+	if err != nil {
+		return false, err
+	}
+	select {
+	case <-waitChan:
+		return true, nil
+	case err = <-errChan:
+		if waitCtx.Err() != nil {
+			log.Info("container still running after stop command, sending stop signal")
+			return false, nil
+		}
+		return false, err
+	}
+}
+
+// Running reports whether the container is running, a missing container isn't
+func (c *Container) Running(cli *client.Client) (running bool, err error) {
+	status, err := c.getStatus(cli, nil, nil)
+	if errors.Is(err, unknownContainer) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return status == "running" || status == "restarting", nil
 }
 
 func (c *Container) Pause(cli *client.Client) (err error) {
@@ -483,16 +709,23 @@ func (c *Container) Kill(cli *client.Client) (err error) {
 
 func (c *Container) deleteContainer(cli *client.Client) (err error) {
 	log.Info("deleting container")
-	cid, err := c.cId(cli)
-	if err != nil {
-		if errors.Is(err, unknownContainer) {
-			return nil
+	// leftovers of an interrupted update are removed as well
+	for _, name := range []string{c.cName(), c.cName() + nextSuffix, c.cName() + oldSuffix, c.cName() + installSuffix} {
+		cid, err := c.findByName(cli, name)
+		if err != nil {
+			if errors.Is(err, unknownContainer) {
+				continue
+			}
+			return err
+		}
+		err = cli.ContainerRemove(context.Background(), cid, container.RemoveOptions{
+			Force: true,
+		})
+		if err != nil {
+			return err
 		}
-		return err
 	}
-	return cli.ContainerRemove(context.Background(), cid, container.RemoveOptions{
-		Force: true,
-	})
+	return nil
 }
 
 func (c *Container) cName() (cname string) {
@@ -500,11 +733,15 @@ func (c *Container) cName() (cname string) {
 }
 
 func (c *Container) cId(cli *client.Client) (cid string, err error) {
+	return c.findByName(cli, c.cName())
+}
+
+func (c *Container) findByName(cli *client.Client, name string) (cid string, err error) {
 	containers, err := cli.ContainerList(context.Background(), container.ListOptions{
 		All: true,
 		Filters: filters.NewArgs(filters.KeyValuePair{
 			Key:   "name",
-			Value: "^/" + c.cName() + "$",
+			Value: "^/" + regexp.QuoteMeta(name) + "$",
 		}),
 	})
 	if err != nil {
@@ -522,6 +759,14 @@ func (c *Container) Destroy(cli *client.Client) (err error) {
 	if err != nil {
 		return err
 	}
+	err = c.deleteVolumes(cli)
+	if err != nil {
+		return err
+	}
+	err = CollectNetworks(cli)
+	if err != nil {
+		return err
+	}
 	err = c.deleteUser()
 	if err != nil {
 		return err
@@ -530,12 +775,31 @@ func (c *Container) Destroy(cli *client.Client) (err error) {
 	if err != nil {
 		return err
 	}
+	err = c.forgetInstall()
+	if err != nil {
+		return err
+	}
+	err = c.forgetDeployKey()
+	if err != nil {
+		return err
+	}
+	err = c.forgetRepository()
+	if err != nil {
+		return err
+	}
+	c.forgetDrops()
 	if os.Getenv("SKIP_IPTABLES") != "true" {
-		firewall, err := c.firewall(make([]Port, 0))
+		firewalls, err := c.firewalls(make([]Port, 0))
 		if err != nil {
 			return err
 		}
-		err = firewall.Uninstall()
+		// both families are uninstalled, regardless of the current addresses
+		for _, firewall := range firewalls {
+			err = firewall.Uninstall()
+			if err != nil {
+				return err
+			}
+		}
 	}
 	return err
 }
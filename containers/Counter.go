@@ -0,0 +1,140 @@
+package containers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"supervisor/client/proto/pipe"
+	"sync"
+	"time"
+)
+
+// the rules counted by the firewall, named in their comment
+const (
+	RuleRateLimit       = "rate-limit"
+	RuleConnectionLimit = "connection-limit"
+	RuleRemote          = "remote"
+	RulePolicy          = "policy"
+)
+
+// Counter is the traffic matched by the rules of a kind for a port, over every address of the container
+type Counter struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	Rule     string `json:"rule"`
+	Packets  uint64 `json:"packets"`
+	Bytes    uint64 `json:"bytes"`
+}
+
+// ruleComment identifies the counted rules of a port
+func ruleComment(rule string, port Port, protocol string) string {
+	return fmt.Sprintf("%s %d/%s", rule, port.Port, protocol)
+}
+
+// parseRuleComment returns the counter of a rule comment, false for rules that aren't counted
+func parseRuleComment(comment string) (counter Counter, ok bool) {
+	_, err := fmt.Sscanf(comment, "%s %d/%s", &counter.Rule, &counter.Port, &counter.Protocol)
+	return counter, err == nil
+}
+
+// addCounter sums the counters of the same rule, one rule is installed per address
+func addCounter(counters []Counter, counter Counter) []Counter {
+	for i := range counters {
+		if counters[i].Rule == counter.Rule && counters[i].Port == counter.Port && counters[i].Protocol == counter.Protocol {
+			counters[i].Packets += counter.Packets
+			counters[i].Bytes += counter.Bytes
+			return counters
+		}
+	}
+	return append(counters, counter)
+}
+
+var (
+	// when the rules of each chain were last replaced, unix milliseconds
+	installs     = make(map[string]int64)
+	installsLock sync.Mutex
+)
+
+// recordInstall notes that the rules of the chain were replaced, their counters started from zero again
+func recordInstall(chain string) {
+	installsLock.Lock()
+	defer installsLock.Unlock()
+	installs[chain] = time.Now().UnixMilli()
+}
+
+// CountersSince returns when the counters of the firewall rules of the container started, at the last install
+// of the firewall, in unix milliseconds. It's 0 when the firewall wasn't installed since the daemon started
+func (c *Container) CountersSince() int64 {
+	installsLock.Lock()
+	defer installsLock.Unlock()
+	return installs[chainPrefix+c.Id]
+}
+
+// Counters returns the counters of the firewall rules of the container, per address family. They count from
+// the last install of the firewall, see CountersSince
+func (c *Container) Counters() (counters map[string][]Counter, err error) {
+	counters = make(map[string][]Counter)
+	if os.Getenv("SKIP_IPTABLES") == "true" {
+		return counters, nil
+	}
+	firewalls, err := c.firewalls(c.Ports)
+	if err != nil {
+		return nil, err
+	}
+	for _, firewall := range firewalls {
+		if len(firewall.Addresses) == 0 {
+			continue
+		}
+		family := "ipv4"
+		if firewall.IPv6 {
+			family = "ipv6"
+		}
+		counters[family], err = firewallBackend().Counters(firewall)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", family, err)
+		}
+	}
+	return counters, nil
+}
+
+// FirewallReport is the firewall activity of a container sent through the firewall pipe
+type FirewallReport struct {
+	Counters map[string][]Counter `json:"counters"`
+	Since    int64                `json:"since"` // unix milliseconds, the counters were reset then
+	Drops    []DropLog            `json:"drops"`
+}
+
+// PipeFirewall sends the counters and the dropped packets logged since the timestamp, then every interval the
+// counters and the packets dropped since the previous report
+func (c *Container) PipeFirewall(ctx context.Context, listener *pipe.Pipe, since int64, interval time.Duration) (err error) {
+	for {
+		// read first, a reset in between shows in the next report
+		installed := c.CountersSince()
+		counters, err := c.Counters()
+		if err != nil {
+			return err
+		}
+		report := FirewallReport{
+			Counters: counters,
+			Since:    installed,
+			Drops:    c.Drops(since),
+		}
+		if len(report.Drops) > 0 {
+			since = report.Drops[len(report.Drops)-1].Timestamp + 1
+		}
+		select {
+		case listener.Forward <- listener.Package(report):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if interval <= 0 {
+			listener.End()
+			return nil
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
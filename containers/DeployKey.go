@@ -0,0 +1,96 @@
+package containers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const deployKeyName = "id_ed25519"
+
+// deployKeyDir holds the deploy key of the container and the pinned host keys, in the daemon state where
+// the tenant can't read them
+func deployKeyDir(id string) (dir string, err error) {
+	dir, err = StateDir("deploy-keys", id)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// DeployKey returns the public half of the deploy key of the container, the key is generated on first use.
+// rotate replaces it, the previous public key has to be removed from the repository then
+func (c *Container) DeployKey(rotate bool) (publicKey string, err error) {
+	dir, err := deployKeyDir(c.Id)
+	if err != nil {
+		return "", err
+	}
+	key := filepath.Join(dir, deployKeyName)
+	if rotate {
+		log.Info("rotating deploy key")
+		for _, file := range []string{key, key + ".pub"} {
+			err = os.Remove(file)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return "", err
+			}
+		}
+	}
+	_, err = os.Stat(key)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Info("generating deploy key")
+		out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "serverbench-"+c.Id, "-f", key).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("ssh-keygen failed: %v: %s", err, out)
+		}
+	} else if err != nil {
+		return "", err
+	}
+	raw, err := os.ReadFile(key + ".pub")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
+
+// sshCommand writes the pinned host keys and returns the ssh command git connects with, authenticated by
+// the deploy key. Unknown host keys are refused, there's no trust on first use
+func (c *Container) sshCommand(knownHosts string) (command string, err error) {
+	if strings.TrimSpace(knownHosts) == "" {
+		return "", errors.New("ssh deployments need the host keys of the git server")
+	}
+	dir, err := deployKeyDir(c.Id)
+	if err != nil {
+		return "", err
+	}
+	key := filepath.Join(dir, deployKeyName)
+	_, err = os.Stat(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", errors.New("the container has no deploy key")
+	}
+	if err != nil {
+		return "", err
+	}
+	hosts := filepath.Join(dir, "known_hosts")
+	err = os.WriteFile(hosts, []byte(strings.TrimSpace(knownHosts)+"\n"), 0600)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("ssh -F /dev/null -i '%s' -o IdentitiesOnly=yes -o UserKnownHostsFile='%s' -o StrictHostKeyChecking=yes", key, hosts), nil
+}
+
+func (c *Container) forgetDeployKey() (err error) {
+	dir, err := StateDir("deploy-keys", c.Id)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,134 @@
+package containers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/client"
+	"github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+)
+
+// labels recorded on the docker container at creation time
+const (
+	imageLabel  = "io.serverbench.image"
+	digestLabel = "io.serverbench.digest"
+)
+
+// ImageStatus describes the image a container runs, and whether the registry has a newer one for its tag
+type ImageStatus struct {
+	Image           string `json:"image"`
+	Digest          string `json:"digest"`           // digest the container was created from
+	Latest          string `json:"latest,omitempty"` // current digest of the tag in the registry
+	Pinned          bool   `json:"pinned"`
+	UpdateAvailable bool   `json:"updateAvailable"`
+}
+
+// imageRef returns the reference to pull and run, pinned to the spec digest when one is provided
+func (c *Container) imageRef() (ref string, err error) {
+	if c.Digest == nil || *c.Digest == "" {
+		return c.Image, nil
+	}
+	pinned, err := digest.Parse(*c.Digest)
+	if err != nil {
+		return "", fmt.Errorf("invalid digest %q: %w", *c.Digest, err)
+	}
+	named, err := reference.ParseNormalizedNamed(c.Image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference %q: %w", c.Image, err)
+	}
+	canonical, err := reference.WithDigest(reference.TrimNamed(named), pinned)
+	if err != nil {
+		return "", err
+	}
+	return canonical.String(), nil
+}
+
+// isPinned reports whether the container always runs the same image, regardless of the tag
+func (c *Container) isPinned() bool {
+	if c.Digest != nil && *c.Digest != "" {
+		return true
+	}
+	named, err := reference.ParseNormalizedNamed(c.Image)
+	if err != nil {
+		return false
+	}
+	_, ok := named.(reference.Digested)
+	return ok
+}
+
+// resolveDigest returns the repository digest of a locally available image
+func resolveDigest(cli *client.Client, ref string) (resolved string, err error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", err
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		return digested.Digest().String(), nil
+	}
+	inspect, err := cli.ImageInspect(context.Background(), ref)
+	if err != nil {
+		return "", err
+	}
+	for _, repoDigest := range inspect.RepoDigests {
+		candidate, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil || candidate.Name() != named.Name() {
+			continue
+		}
+		if digested, ok := candidate.(reference.Digested); ok {
+			return digested.Digest().String(), nil
+		}
+	}
+	// e.g. images that were built locally and never pushed
+	return "", errors.New("no repository digest for " + ref)
+}
+
+// digestLabels returns the labels recording the image the container is created from
+func (c *Container) digestLabels(cli *client.Client, ref string) map[string]string {
+	labels := map[string]string{
+		imageLabel: c.Image,
+	}
+	resolved, err := resolveDigest(cli, ref)
+	if err != nil {
+		log.Info("unable to resolve image digest: ", err)
+		return labels
+	}
+	labels[digestLabel] = resolved
+	return labels
+}
+
+// ImageStatus returns the digest the container runs, when checkRegistry is set the registry is asked
+// for the current digest of the tag
+func (c *Container) ImageStatus(cli *client.Client, checkRegistry bool) (status ImageStatus, err error) {
+	status = ImageStatus{
+		Image:  c.Image,
+		Pinned: c.isPinned(),
+	}
+	cid, err := c.cId(cli)
+	if err != nil {
+		return status, err
+	}
+	inspect, err := cli.ContainerInspect(context.Background(), cid)
+	if err != nil {
+		return status, err
+	}
+	status.Digest = inspect.Config.Labels[digestLabel]
+	if !checkRegistry || status.Pinned || status.Digest == "" {
+		return status, nil
+	}
+	auth, err := c.registryAuth(c.Image)
+	if err != nil {
+		return status, err
+	}
+	distribution, err := cli.DistributionInspect(context.Background(), c.Image, auth)
+	if err != nil {
+		return status, err
+	}
+	status.Latest = distribution.Descriptor.Digest.String()
+	// a multi-platform tag resolves to the digest of its index, which is also what pulls record
+	status.UpdateAvailable = !strings.EqualFold(status.Latest, status.Digest)
+	return status, nil
+}
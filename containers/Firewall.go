@@ -1,14 +1,12 @@
 package containers
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
-	"github.com/coreos/go-iptables/iptables"
 	log "github.com/sirupsen/logrus"
 	"net"
-	"os/exec"
-	"strconv"
+	"os"
+	"sync"
 )
 
 const tcp = "tcp"
@@ -16,179 +14,233 @@ const udp = "udp"
 
 var protocols = []string{tcp, udp}
 
+// the network namespace of the host, the firewalls are applied there
+const hostNetNS = "/mnt/host_netns"
+
+// Firewall backends
 const (
-	table     = "filter"
-	forward   = "serverbench"
-	tlForward = "DOCKER-USER"
-	hostNetNS = "/mnt/host_netns"
+	BackendIptables = "iptables"
+	BackendNftables = "nftables"
+	BackendAuto     = "auto"
 )
 
-func nsenterIptables(args ...string) error {
-	cmdArgs := append([]string{"--net=" + hostNetNS, "iptables"}, args...)
-	cmd := exec.Command("nsenter", cmdArgs...)
+// Backend applies the firewalls to the host
+type Backend interface {
+	Name() string
+	// Install replaces the rules of the chain with the ones of the firewall, without ever exposing an empty
+	// or half-filled chain
+	Install(f Firewall) error
+	// Uninstall removes the chain, if it exists
+	Uninstall(f Firewall) error
+	// Check compares the installed rules with the firewall and describes each difference
+	Check(f Firewall) (drift []string, err error)
+	// Counters returns the counters of the counted rules of the chain
+	Counters(f Firewall) (counters []Counter, err error)
+	// Plan compares the installed rules with the ones Install would add, without changing them
+	Plan(f Firewall) (plan FirewallPlan, err error)
+	// Collect uninstalls the container chains of the family that aren't kept, along with their sets, and
+	// returns the removed chains
+	Collect(v6 bool, keep []string) (removed []string, err error)
+	// InstallHost replaces the rules of the host chain of the family
+	InstallHost(h HostFirewall, v6 bool) error
+	// UninstallHost removes the host chain of the family, if it exists
+	UninstallHost(v6 bool) error
+	// Teardown removes every chain, set and jump the backend installed, in both families
+	Teardown() error
+}
+
+var (
+	backend     Backend
+	backendLock sync.Mutex
+)
 
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
+// SelectBackend picks the firewall backend from FIREWALL_BACKEND (iptables, nftables or auto, the default).
+// auto uses nftables when the host rules are managed through nftables (docker on iptables-nft), iptables
+// otherwise, so both never end up mixed
+func SelectBackend() (selected Backend, err error) {
+	backendLock.Lock()
+	defer backendLock.Unlock()
+	name := os.Getenv("FIREWALL_BACKEND")
+	switch name {
+	case BackendIptables:
+		backend = iptablesBackend{}
+	case BackendNftables:
+		backend = nftablesBackend{}
+	case BackendAuto, "":
+		if nftablesNative() {
+			backend = nftablesBackend{}
+		} else {
+			backend = iptablesBackend{}
+		}
+	default:
+		return nil, fmt.Errorf("invalid firewall backend %q", name)
+	}
+	log.Info("using the ", backend.Name(), " firewall backend")
+	return backend, nil
+}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("iptables %v failed: %v: %s", args, err, stderr.String())
+// firewallBackend returns the selected backend, iptables when none was selected
+func firewallBackend() Backend {
+	backendLock.Lock()
+	defer backendLock.Unlock()
+	if backend == nil {
+		backend = iptablesBackend{}
 	}
-	return nil
+	return backend
 }
 
+// the chain of a container is named after its id
+const chainPrefix = "sb-"
+
+// Firewall is the chain of a container in one address family
 type Firewall struct {
-	Chain    string
-	Address  string
-	Iptables *iptables.IPTables
-	Ports    []Port
+	Chain     string
+	IPv6      bool
+	Addresses []string
+	Ports     []Port
 }
 
-func (c *Container) firewall(ports []Port) (firewall Firewall, err error) {
-	ip := net.ParseIP(c.Address)
+// isIPv6 reports whether an address or a CIDR is an IPv6 one
+func isIPv6(address string) bool {
+	ip := net.ParseIP(address)
 	if ip == nil {
-		return firewall, errors.New("invalid address")
-	}
-	var path string
-	if ip.To4() == nil {
-		path = "/wrapper/ip6tables"
-	} else {
-		path = "/wrapper/iptables"
-	}
-	instance, err := iptables.New(iptables.Path(path))
-	if err != nil {
-		return firewall, err
-	}
-	log.Info("firewall created for ", c.Address)
-	firewall = Firewall{
-		Chain:    "sb-" + c.Id,
-		Address:  c.Address,
-		Iptables: instance,
-		Ports:    ports,
+		var err error
+		ip, _, err = net.ParseCIDR(address)
+		if err != nil {
+			return false
+		}
 	}
-	return firewall, err
+	return ip.To4() == nil
+}
+
+// firewalls returns the firewall of each address family, a family without addresses gets a firewall without
+// addresses, which uninstalls its chain
+func (c *Container) firewalls(ports []Port) (firewalls []Firewall, err error) {
+	for _, v6 := range []bool{false, true} {
+		addresses := make([]string, 0)
+		for _, address := range c.addresses() {
+			if net.ParseIP(address) == nil {
+				return nil, errors.New("invalid address " + address)
+			}
+			if isIPv6(address) == v6 {
+				addresses = append(addresses, address)
+			}
+		}
+		log.Info("firewall created for ", addresses)
+		firewalls = append(firewalls, Firewall{
+			Chain:     chainPrefix + c.Id,
+			IPv6:      v6,
+			Addresses: addresses,
+			Ports:     ports,
+		})
+	}
+	return firewalls, nil
 }
 
 // Install refreshes or installs firewall
 func (f Firewall) Install() (err error) {
-	err = f.ensureParentChain()
-	if err != nil {
-		return err
-	}
-	log.Info("installing chain")
-	err = f.ensureChain()
-	if err != nil {
-		return err
+	if len(f.Addresses) == 0 {
+		return f.Uninstall()
 	}
-	err = f.flushChain()
-	if err != nil {
-		return err
+	err = firewallBackend().Install(f)
+	if err == nil {
+		recordInstall(f.Chain)
 	}
-	for _, port := range f.Ports {
-		err = f.securePort(port)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return err
 }
 
 func (f Firewall) Uninstall() (err error) {
-	log.Info("uninstalling chain")
-	err = f.ensureChain()
-	if err != nil {
-		return err
+	err = firewallBackend().Uninstall(f)
+	if err == nil {
+		recordInstall(f.Chain)
 	}
-	return f.deleteChain()
+	return err
 }
 
-func (f Firewall) deleteChain() error {
-	log.Info("deleting chain rules")
+// Check returns the differences between the installed rules and the firewall, none when it's in place
+func (f Firewall) Check() (drift []string, err error) {
+	return firewallBackend().Check(f)
+}
 
-	// Remove the jump rule from FORWARD
-	err := f.Iptables.DeleteIfExists(table, forward, "-j", f.Chain)
-	if err != nil {
-		return fmt.Errorf("failed to remove jump rule from FORWARD: %w", err)
+// FirewallDrift returns the differences between the installed firewalls and the ports of the container
+func (c *Container) FirewallDrift() (drift []string, err error) {
+	if os.Getenv("SKIP_IPTABLES") == "true" {
+		return nil, nil
 	}
-
-	// Delete the custom chain
-	err = f.Iptables.ClearAndDeleteChain(table, f.Chain)
+	err = requireGeoIP(c.Ports)
 	if err != nil {
-		return fmt.Errorf("failed to delete chain: %w", err)
+		return nil, err
 	}
-	return nil
-}
-
-// flush chain rules
-func (f Firewall) flushChain() (err error) {
-	log.Info("flushing chain")
-	return f.Iptables.ClearChain(table, f.Chain)
-}
-
-// creates the rules for securing that port
-func (f Firewall) securePort(port Port) (err error) {
-	log.Info("securing port")
-	var unmatchPolicy string
-	if port.Policy == Drop {
-		unmatchPolicy = Accept
-	} else {
-		unmatchPolicy = Drop
+	firewalls, err := c.firewalls(c.Ports)
+	if err != nil {
+		return nil, err
 	}
-	for _, remote := range port.Remotes {
-		for _, protocol := range protocols {
-			err = f.Iptables.AppendUnique(table, f.Chain, "-p", protocol, "-m", "conntrack", "--ctorigsrc", remote, "--ctorigdst", f.Address, "--ctorigdstport", strconv.Itoa(port.Port), "-j", unmatchPolicy)
-			if err != nil {
-				return err
-			}
+	for _, firewall := range firewalls {
+		family := "ipv4"
+		if firewall.IPv6 {
+			family = "ipv6"
 		}
-	}
-	for _, protocol := range protocols {
-		err = f.Iptables.AppendUnique(table, f.Chain, "-p", protocol, "-m", "conntrack", "--ctorigdst", f.Address, "--ctorigdstport", strconv.Itoa(port.Port), "-j", port.Policy)
+		differences, err := firewall.Check()
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("%s: %w", family, err)
+		}
+		for _, difference := range differences {
+			drift = append(drift, family+": "+difference)
 		}
 	}
-	log.Info("secured port")
-	return err
+	return drift, nil
 }
 
-func (f Firewall) ensureParentChain() (err error) {
-	log.Info("ensuring parent chain")
-	exists, err := f.Iptables.ChainExists(table, forward)
-	if err != nil {
-		return err
-	}
-	if !exists {
-		log.Info("parent chain was missing, creating chain")
-		err = f.Iptables.NewChain(table, forward)
-		log.Info("created parent chain, adding default forwarding rule")
-		err = f.Iptables.InsertUnique(table, tlForward, 1, "-j", forward)
-		if err != nil {
-			return err
+// CollectFirewalls uninstalls the chains of the containers that aren't managed anymore, left behind when a
+// container was deleted outside the daemon or its destroy failed midway. Every chain of the other backend is
+// left behind as well, by a daemon that selected it before, so it's collected entirely
+func CollectFirewalls(managed []string) (removed []string, err error) {
+	if os.Getenv("SKIP_IPTABLES") == "true" {
+		return nil, nil
+	}
+	keep := make([]string, 0, len(managed))
+	for _, id := range managed {
+		keep = append(keep, chainPrefix+id)
+	}
+	selected := firewallBackend()
+	for _, b := range []Backend{iptablesBackend{}, nftablesBackend{}} {
+		kept := keep
+		if b.Name() != selected.Name() {
+			kept = nil
+		}
+		for _, v6 := range []bool{false, true} {
+			family := "ipv4"
+			if v6 {
+				family = "ipv6"
+			}
+			chains, err := b.Collect(v6, kept)
+			for _, chain := range chains {
+				removed = append(removed, b.Name()+" "+family+": "+chain)
+			}
+			if err != nil && b.Name() != selected.Name() {
+				// the host may not support the other backend at all
+				log.Info("unable to collect the ", b.Name(), " ", family, " firewall: ", err)
+				continue
+			}
+			if err != nil {
+				return removed, fmt.Errorf("%s %s: %w", b.Name(), family, err)
+			}
 		}
-		log.Info("parent chain setup finished")
 	}
-	return err
+	return removed, nil
 }
 
-// creates the priority chain to bypass docker default iptables
-func (f Firewall) ensureChain() (err error) {
-	log.Info("retrieving chain")
-	exists, err := f.Iptables.ChainExists(table, f.Chain)
-	if err != nil {
-		return err
-	}
-	if !exists {
-		log.Info("chain was missing, creating chain")
-		err = f.Iptables.NewChain(table, f.Chain)
-		if err != nil {
-			return err
-		}
-		log.Info("created chain, adding default forwarding rule")
-		err = f.Iptables.AppendUnique(table, forward, "-j", f.Chain)
+// TeardownFirewalls removes everything the daemon installed in the host firewall, including the parent
+// chains, when it's removed from the host. Both backends are torn down, as the selected one may have changed
+// since the rules were installed
+func TeardownFirewalls() error {
+	var errs []error
+	for _, b := range []Backend{iptablesBackend{}, nftablesBackend{}} {
+		log.Info("tearing down the ", b.Name(), " firewall")
+		err := b.Teardown()
 		if err != nil {
-			return err
+			errs = append(errs, fmt.Errorf("%s: %w", b.Name(), err))
 		}
-		log.Info("chain setup finished")
 	}
-	return nil
+	return errors.Join(errs...)
 }
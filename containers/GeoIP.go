@@ -0,0 +1,374 @@
+package containers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// the marker starting the metadata section of MaxMind DB files, anything else is read as CSV
+var mmdbMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+var countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// countryNetworks are the networks of a country, per address family
+type countryNetworks struct {
+	v4 []string
+	v6 []string
+}
+
+type geoDatabase struct {
+	path      string
+	modified  time.Time
+	countries map[string]*countryNetworks
+}
+
+var (
+	geoip     *geoDatabase
+	geoipLock sync.Mutex
+)
+
+// GeoIPPath returns the country database, from GEOIP_DATABASE or in the state directory. It's either a
+// MaxMind DB (e.g. GeoLite2-Country.mmdb) or a CSV file of network,country or first,last,country lines
+func GeoIPPath() (string, error) {
+	if path := os.Getenv("GEOIP_DATABASE"); path != "" {
+		return path, nil
+	}
+	return StateDir("geoip.db")
+}
+
+// addNetwork adds the network to the country, in its family
+func (d *geoDatabase) addNetwork(country string, prefix netip.Prefix) {
+	country = strings.ToUpper(country)
+	networks, ok := d.countries[country]
+	if !ok {
+		networks = &countryNetworks{}
+		d.countries[country] = networks
+	}
+	if prefix.Addr().Is4() {
+		networks.v4 = append(networks.v4, prefix.String())
+	} else {
+		networks.v6 = append(networks.v6, prefix.String())
+	}
+}
+
+// readMMDB reads the country of every network, the registered one when the network has none
+func (d *geoDatabase) readMMDB(raw []byte) (err error) {
+	reader, err := maxminddb.FromBytes(raw)
+	if err != nil {
+		return err
+	}
+	type country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	}
+	networks := reader.Networks(maxminddb.SkipAliasedNetworks)
+	for networks.Next() {
+		var record struct {
+			Country           country `maxminddb:"country"`
+			RegisteredCountry country `maxminddb:"registered_country"`
+		}
+		network, err := networks.Network(&record)
+		if err != nil {
+			return err
+		}
+		code := record.Country.ISOCode
+		if code == "" {
+			code = record.RegisteredCountry.ISOCode
+		}
+		if code == "" {
+			continue
+		}
+		prefix, err := ipNetPrefix(network)
+		if err != nil {
+			return err
+		}
+		d.addNetwork(code, prefix)
+	}
+	return networks.Err()
+}
+
+// ipNetPrefix converts the network, IPv4 networks of an IPv6 database are unmapped
+func ipNetPrefix(network *net.IPNet) (prefix netip.Prefix, err error) {
+	addr, ok := netip.AddrFromSlice(network.IP)
+	if !ok {
+		return prefix, fmt.Errorf("invalid network %s", network)
+	}
+	bits, _ := network.Mask.Size()
+	if addr.Is4In6() {
+		addr = addr.Unmap()
+		bits -= 96
+	}
+	return netip.PrefixFrom(addr, bits).Masked(), nil
+}
+
+// readCSV reads network,country or first,last,country lines, the first line may be a header
+func (d *geoDatabase) readCSV(raw []byte) (err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		for i := range fields {
+			fields[i] = strings.Trim(strings.TrimSpace(fields[i]), `"`)
+		}
+		prefixes, country, err := csvNetworks(fields)
+		if err != nil {
+			if line == 1 {
+				continue
+			}
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		for _, prefix := range prefixes {
+			d.addNetwork(country, prefix)
+		}
+	}
+	return scanner.Err()
+}
+
+func csvNetworks(fields []string) (prefixes []netip.Prefix, country string, err error) {
+	switch len(fields) {
+	case 2:
+		prefix, err := parseRemote(fields[0])
+		if err != nil {
+			return nil, "", err
+		}
+		return []netip.Prefix{prefix}, fields[1], nil
+	case 3:
+		first, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid address %q", fields[0])
+		}
+		last, err := netip.ParseAddr(fields[1])
+		if err != nil || last.Is4() != first.Is4() || last.Less(first) {
+			return nil, "", fmt.Errorf("invalid range %s-%s", fields[0], fields[1])
+		}
+		return rangePrefixes(first, last), fields[2], nil
+	default:
+		return nil, "", fmt.Errorf("expected 2 or 3 fields, got %d", len(fields))
+	}
+}
+
+// rangePrefixes splits an inclusive range into the fewest prefixes covering it
+func rangePrefixes(first netip.Addr, last netip.Addr) (prefixes []netip.Prefix) {
+	for {
+		bits := first.BitLen()
+		// widen the prefix while it starts at first and ends before last
+		for bits > 0 {
+			wider := netip.PrefixFrom(first, bits-1)
+			if wider.Masked().Addr() != first || lastAddress(wider).Compare(last) > 0 {
+				break
+			}
+			bits--
+		}
+		prefix := netip.PrefixFrom(first, bits)
+		prefixes = append(prefixes, prefix)
+		end := lastAddress(prefix)
+		if end == last {
+			return prefixes
+		}
+		first = end.Next()
+	}
+}
+
+// loadGeoIP reads the database at path
+func loadGeoIP(path string) (db *geoDatabase, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db = &geoDatabase{
+		path:      path,
+		modified:  info.ModTime(),
+		countries: make(map[string]*countryNetworks),
+	}
+	if bytes.Contains(raw, mmdbMarker) {
+		err = db.readMMDB(raw)
+	} else {
+		err = db.readCSV(raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid geoip database %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// RefreshGeoIP reloads the country database when it changed on disk, changed is set when it was (re)loaded.
+// A missing database is fine as long as no port uses countries
+func RefreshGeoIP() (changed bool, err error) {
+	path, err := GeoIPPath()
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(path)
+	geoipLock.Lock()
+	defer geoipLock.Unlock()
+	if errors.Is(err, os.ErrNotExist) {
+		changed = geoip != nil
+		geoip = nil
+		return changed, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if geoip != nil && geoip.path == path && geoip.modified.Equal(info.ModTime()) {
+		return false, nil
+	}
+	db, err := loadGeoIP(path)
+	if err != nil {
+		return false, err
+	}
+	log.Info("loaded geoip database ", path, " with ", len(db.countries), " countries")
+	geoip = db
+	return true, nil
+}
+
+// countryRemotes returns the networks of the countries in the address family
+func countryRemotes(countries []string, v6 bool) (remotes []string) {
+	if len(countries) == 0 {
+		return nil
+	}
+	geoipLock.Lock()
+	defer geoipLock.Unlock()
+	if geoip == nil {
+		return nil
+	}
+	for _, country := range countries {
+		networks, ok := geoip.countries[country]
+		if !ok {
+			continue
+		}
+		if v6 {
+			remotes = append(remotes, networks.v6...)
+		} else {
+			remotes = append(remotes, networks.v4...)
+		}
+	}
+	return remotes
+}
+
+// requireGeoIP fails when a port uses countries while no database is loaded, the firewall would let every
+// remote of its countries through (or none) otherwise
+func requireGeoIP(ports []Port) error {
+	geoipLock.Lock()
+	defer geoipLock.Unlock()
+	if geoip != nil {
+		return nil
+	}
+	for _, p := range ports {
+		if len(p.Countries) > 0 {
+			return fmt.Errorf("port %d uses countries but no geoip database is loaded", p.Port)
+		}
+	}
+	return nil
+}
+
+// validateCountries rejects invalid codes and countries missing from the database
+func validateCountries(countries []string) error {
+	if len(countries) == 0 {
+		return nil
+	}
+	geoipLock.Lock()
+	defer geoipLock.Unlock()
+	if geoip == nil {
+		return errors.New("no geoip database is loaded")
+	}
+	for _, country := range countries {
+		if !countryPattern.MatchString(country) {
+			return fmt.Errorf("invalid country %q", country)
+		}
+		if _, ok := geoip.countries[country]; !ok {
+			return fmt.Errorf("unknown country %q", country)
+		}
+	}
+	return nil
+}
+
+// GeoIPUpdate is a country database published by the control plane
+type GeoIPUpdate struct {
+	Url    string `json:"url"`
+	Sha256 string `json:"sha256"`
+}
+
+// Download replaces the country database with the published one, once its checksum matches, then reloads it
+func (u GeoIPUpdate) Download() (changed bool, err error) {
+	path, err := GeoIPPath()
+	if err != nil {
+		return false, err
+	}
+	log.Info("downloading geoip database from ", u.Url)
+	client := http.Client{Timeout: 10 * time.Minute}
+	response, err := client.Get(u.Url)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("geoip download failed: %s", response.Status)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return false, err
+	}
+	temporary := path + ".tmp"
+	file, err := os.OpenFile(temporary, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(temporary)
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), response.Body)
+	closeErr := file.Close()
+	if err != nil {
+		return false, err
+	}
+	if closeErr != nil {
+		return false, closeErr
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(sum, u.Sha256) {
+		return false, fmt.Errorf("geoip checksum mismatch: got %s, expected %s", sum, u.Sha256)
+	}
+	// checked before it replaces the current one
+	_, err = loadGeoIP(temporary)
+	if err != nil {
+		return false, err
+	}
+	err = os.Rename(temporary, path)
+	if err != nil {
+		return false, err
+	}
+	return RefreshGeoIP()
+}
+
+// HasCountries reports whether a port of the container uses countries, its firewall depends on the database
+func (c *Container) HasCountries() bool {
+	for _, p := range c.Ports {
+		if len(p.Countries) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package containers
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// expectCountries compares the networks of the database per country and family
+func expectCountries(t *testing.T, db *geoDatabase, expected map[string]countryNetworks) {
+	t.Helper()
+	if len(db.countries) != len(expected) {
+		t.Errorf("got %d countries, expected %d", len(db.countries), len(expected))
+	}
+	for country, networks := range expected {
+		got, ok := db.countries[country]
+		if !ok {
+			t.Errorf("missing country %s", country)
+			continue
+		}
+		if !slices.Equal(got.v4, networks.v4) || !slices.Equal(got.v6, networks.v6) {
+			t.Errorf("%s: got %v %v, expected %v %v", country, got.v4, got.v6, networks.v4, networks.v6)
+		}
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	raw, err := os.ReadFile("testdata/countries.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &geoDatabase{countries: make(map[string]*countryNetworks)}
+	err = db.readCSV(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCountries(t, db, map[string]countryNetworks{
+		"FR": {v4: []string{"192.0.2.0/24"}, v6: []string{"2001:db8::/32"}},
+		"DE": {v4: []string{"198.51.100.0/24"}, v6: []string{"2001:db8:1::/127", "2001:db8:1::2/128"}},
+		"US": {v4: []string{"203.0.113.7/32"}},
+	})
+
+	for _, invalid := range []string{
+		"network,country\n192.0.2.0/24,FR\nnot a network,DE\n",
+		"192.0.2.0/24,FR\n192.0.2.0/24\n",
+	} {
+		db := &geoDatabase{countries: make(map[string]*countryNetworks)}
+		err = db.readCSV([]byte(invalid))
+		if err == nil || !strings.HasPrefix(err.Error(), "line ") {
+			t.Errorf("%q: expected a line error, got %v", invalid, err)
+		}
+	}
+}
+
+func TestCsvNetworks(t *testing.T) {
+	tests := []struct {
+		fields   []string
+		prefixes []string
+		country  string
+		invalid  bool
+	}{
+		{fields: []string{"192.0.2.0/24", "FR"}, prefixes: []string{"192.0.2.0/24"}, country: "FR"},
+		{fields: []string{"192.0.2.1", "FR"}, prefixes: []string{"192.0.2.1/32"}, country: "FR"},
+		{fields: []string{"192.0.2.0", "192.0.2.4", "DE"}, prefixes: []string{"192.0.2.0/30", "192.0.2.4/32"}, country: "DE"},
+		{fields: []string{"2001:db8::", "2001:db8::ffff", "DE"}, prefixes: []string{"2001:db8::/112"}, country: "DE"},
+		{fields: []string{"192.0.2.0/24"}, invalid: true},
+		{fields: []string{"192.0.2.0", "192.0.2.1", "FR", "extra"}, invalid: true},
+		{fields: []string{"network", "country"}, invalid: true},
+		{fields: []string{"192.0.2.4", "192.0.2.0", "FR"}, invalid: true},
+		{fields: []string{"192.0.2.0", "2001:db8::", "FR"}, invalid: true},
+		{fields: []string{"first", "192.0.2.0", "FR"}, invalid: true},
+	}
+	for _, test := range tests {
+		prefixes, country, err := csvNetworks(test.fields)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%v: expected an error", test.fields)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.fields, err)
+			continue
+		}
+		got := make([]string, 0, len(prefixes))
+		for _, prefix := range prefixes {
+			got = append(got, prefix.String())
+		}
+		if !slices.Equal(got, test.prefixes) || country != test.country {
+			t.Errorf("%v: got %v %s, expected %v %s", test.fields, got, country, test.prefixes, test.country)
+		}
+	}
+}
+
+func TestRangePrefixes(t *testing.T) {
+	tests := []struct {
+		first    string
+		last     string
+		prefixes []string
+	}{
+		{"192.0.2.1", "192.0.2.1", []string{"192.0.2.1/32"}},
+		{"192.0.2.0", "192.0.2.255", []string{"192.0.2.0/24"}},
+		{"192.0.2.1", "192.0.2.6", []string{"192.0.2.1/32", "192.0.2.2/31", "192.0.2.4/31", "192.0.2.6/32"}},
+		{"192.0.2.255", "192.0.3.0", []string{"192.0.2.255/32", "192.0.3.0/32"}},
+		{"0.0.0.0", "255.255.255.255", []string{"0.0.0.0/0"}},
+		{"255.255.255.254", "255.255.255.255", []string{"255.255.255.254/31"}},
+		{"::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", []string{"::/0"}},
+		{"2001:db8::", "2001:db8::2", []string{"2001:db8::/127", "2001:db8::2/128"}},
+	}
+	for _, test := range tests {
+		prefixes := rangePrefixes(netip.MustParseAddr(test.first), netip.MustParseAddr(test.last))
+		got := make([]string, 0, len(prefixes))
+		for _, prefix := range prefixes {
+			got = append(got, prefix.String())
+		}
+		if !slices.Equal(got, test.prefixes) {
+			t.Errorf("%s-%s: got %v, expected %v", test.first, test.last, got, test.prefixes)
+		}
+	}
+}
+
+func TestReadMMDB(t *testing.T) {
+	raw, err := os.ReadFile("testdata/countries.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &geoDatabase{countries: make(map[string]*countryNetworks)}
+	err = db.readMMDB(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the US network only has a registered country
+	expectCountries(t, db, map[string]countryNetworks{
+		"FR": {v4: []string{"192.0.2.0/24"}, v6: []string{"2001:db8::/32"}},
+		"DE": {v4: []string{"198.51.100.0/24"}},
+		"US": {v4: []string{"203.0.113.0/24"}},
+	})
+}
+
+func TestLoadGeoIP(t *testing.T) {
+	for _, path := range []string{"testdata/countries.mmdb", "testdata/countries.csv"} {
+		db, err := loadGeoIP(path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if len(db.countries) != 3 {
+			t.Errorf("%s: got %d countries, expected 3", path, len(db.countries))
+		}
+	}
+}
+
+func TestIpNetPrefix(t *testing.T) {
+	tests := []struct {
+		network string
+		mapped  bool // the IPv4 network is stored in the IPv4-mapped IPv6 form
+		prefix  string
+	}{
+		{"192.0.2.0/24", false, "192.0.2.0/24"},
+		{"192.0.2.0/24", true, "192.0.2.0/24"},
+		{"0.0.0.0/0", true, "0.0.0.0/0"},
+		{"2001:db8::/32", false, "2001:db8::/32"},
+	}
+	for _, test := range tests {
+		_, network, err := net.ParseCIDR(test.network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.mapped {
+			bits, _ := network.Mask.Size()
+			network = &net.IPNet{IP: network.IP.To16(), Mask: net.CIDRMask(bits+96, 128)}
+		}
+		prefix, err := ipNetPrefix(network)
+		if err != nil {
+			t.Errorf("%s: %v", network, err)
+			continue
+		}
+		if prefix.String() != test.prefix {
+			t.Errorf("%s: got %s, expected %s", network, prefix, test.prefix)
+		}
+	}
+}
+
+func TestRequireGeoIP(t *testing.T) {
+	geoipLock.Lock()
+	previous := geoip
+	geoip = nil
+	geoipLock.Unlock()
+	t.Cleanup(func() {
+		geoipLock.Lock()
+		geoip = previous
+		geoipLock.Unlock()
+	})
+	ports := []Port{{Port: 25565, Policy: Drop, Countries: []string{"FR"}}}
+	if err := requireGeoIP(ports); err == nil {
+		t.Error("countries are accepted without a database")
+	}
+	if err := requireGeoIP([]Port{{Port: 25565, Policy: Drop}}); err != nil {
+		t.Errorf("ports without countries require a database: %v", err)
+	}
+	db, err := loadGeoIP("testdata/countries.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	geoipLock.Lock()
+	geoip = db
+	geoipLock.Unlock()
+	if err := requireGeoIP(ports); err != nil {
+		t.Error(err)
+	}
+	if remotes := ports[0].remotes(false); !slices.Equal(remotes, []string{"192.0.2.0/24"}) {
+		t.Errorf("got remotes %v, expected the networks of FR", remotes)
+	}
+}
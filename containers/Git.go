@@ -3,34 +3,69 @@ package containers
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
 	"strings"
 
 	"github.com/docker/docker/client"
 	log "github.com/sirupsen/logrus"
-	"github.com/thanhpk/randstr"
 )
 
-func (c *Container) GetCommit() (commit *string, err error) {
-	if c.Branch == nil {
-		return nil, nil
+// the ref of the repository the container tree is checked out from
+const deployedRef = "refs/serverbench/deployed"
+
+// repositoryDir returns the bare repository the container deploys from, created on first use. It lives in the
+// daemon state: the credentials are only used there, out of reach of the tenant and of the config it controls
+func (c *Container) repositoryDir() (dir string, err error) {
+	parent, err := StateDir("repositories")
+	if err != nil {
+		return "", err
 	}
-	isRepo, err := c.isGitRepository()
+	err = os.MkdirAll(parent, 0700)
 	if err != nil {
-		log.Error(err)
-		return nil, err
+		return "", err
+	}
+	dir = filepath.Join(parent, c.Id)
+	_, err = os.Stat(filepath.Join(dir, "HEAD"))
+	if errors.Is(err, os.ErrNotExist) {
+		log.Info("initializing repository")
+		out, err := gitCommand("init", "--quiet", "--bare", dir).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("git init failed: %v: %s", err, out)
+		}
+	} else if err != nil {
+		return "", err
 	}
-	if !isRepo {
+	return dir, nil
+}
+
+func (c *Container) forgetRepository() (err error) {
+	dir, err := StateDir("repositories", c.Id)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (c *Container) GetCommit() (commit *string, err error) {
+	if c.Branch == nil {
 		return nil, nil
 	}
-	err = c.Whitelist()
+	parent, err := StateDir("repositories")
 	if err != nil {
 		return nil, err
 	}
-	cmd := exec.Command("git", "-C", c.Dir(), "rev-parse", "HEAD")
+	gitDir := filepath.Join(parent, c.Id)
+	if _, err := os.Stat(filepath.Join(gitDir, "HEAD")); errors.Is(err, os.ErrNotExist) {
+		// deployed before the repository moved to the daemon state, the clone sits in the container tree
+		gitDir = filepath.Join(c.Dir(), ".git")
+		if info, err := os.Stat(gitDir); err != nil || !info.IsDir() {
+			return nil, nil
+		}
+	}
+	cmd := gitCommand("-c", "safe.directory="+gitDir, "--git-dir", gitDir, "rev-parse", "HEAD")
 
 	var out bytes.Buffer
 	cmd.Stdout = &out
@@ -44,31 +79,114 @@ func (c *Container) GetCommit() (commit *string, err error) {
 	return &commitHash, nil
 }
 
-func (c *Container) isGitRepository() (isRepo bool, err error) {
-	dataPath := c.Dir()
-	gitDir := path.Join(dataPath, ".git")
-	info, err := os.Stat(gitDir)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return false, nil
+// the token is handed to git by a credential helper reading it from fd 3, only for https requests to the host
+// of the repository
+const credentialHelper = `!f() { test "$1" = get || return 0; ` +
+	`while IFS= read -r line && test -n "$line"; do case "$line" in protocol=*) protocol=${line#protocol=};; host=*) host=${line#host=};; esac; done; ` +
+	`test "$protocol" = https && test "$host" = "$SERVERBENCH_GIT_HOST" && echo "username=$SERVERBENCH_GIT_USERNAME" && IFS= read -r password <&3 && echo "password=$password"; }; f`
+
+// GitAuth is how a deployment reaches its repository: over HTTPS with a token, or over SSH with the deploy
+// key of the container and the pinned host keys of the server
+type GitAuth struct {
+	Domain     string
+	Uri        string
+	Token      string
+	Username   string // goes with the token, x-access-token (GitHub) when empty
+	Ssh        bool
+	KnownHosts string // known_hosts lines of the server, required over SSH
+}
+
+// remoteUrl returns the url of the repository, without any credential
+func (a GitAuth) remoteUrl() string {
+	if a.Ssh {
+		return "ssh://git@" + a.Domain + "/" + a.Uri
+	}
+	return "https://" + a.Domain + "/" + a.Uri
+}
+
+// gitCommand returns a git command reading no config but the repository one: the system and global configs
+// are skipped, hooks and fsmonitor are off. It only runs on the repositories of the daemon, with the container
+// tree as work tree at most, so the tenant never controls a config, a filter or a merge driver it runs
+func gitCommand(args ...string) *exec.Cmd {
+	config := []string{
+		"-c", "core.hooksPath=/dev/null",
+		"-c", "core.fsmonitor=false",
+	}
+	cmd := exec.Command("git", append(config, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_CONFIG_NOSYSTEM=1", "GIT_CONFIG_GLOBAL=/dev/null")
+	return cmd
+}
+
+// authenticated returns a git command authenticated with auth. The token is written to a pipe read by the
+// credential helper, it never shows in an environment, a command line or a config. done releases the pipe
+func (c *Container) authenticated(auth GitAuth, args ...string) (cmd *exec.Cmd, done func(), err error) {
+	done = func() {}
+	if auth.Ssh {
+		command, err := c.sshCommand(auth.KnownHosts)
+		if err != nil {
+			return nil, nil, err
 		}
-		return false, err
+		cmd = gitCommand(args...)
+		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND="+command)
+		return cmd, done, nil
+	}
+	if auth.Token == "" {
+		return gitCommand(args...), done, nil
+	}
+	username := auth.Username
+	if username == "" {
+		username = "x-access-token"
 	}
-	return info.IsDir(), nil
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	// a token is far below the pipe capacity, the write doesn't wait for the helper
+	_, err = writer.WriteString(auth.Token + "\n")
+	writer.Close()
+	if err != nil {
+		reader.Close()
+		return nil, nil, err
+	}
+	// the empty helper drops the configured ones
+	cmd = gitCommand(append([]string{"-c", "credential.helper=", "-c", "credential.helper=" + credentialHelper}, args...)...)
+	cmd.Env = append(cmd.Env, "SERVERBENCH_GIT_HOST="+auth.Domain, "SERVERBENCH_GIT_USERNAME="+username)
+	cmd.ExtraFiles = []*os.File{reader}
+	return cmd, func() { reader.Close() }, nil
 }
 
-func (c *Container) Whitelist() (err error) {
-	dataPath := c.Dir()
-	log.Info("whitelisting repo")
-	err = exec.Command("git", "config", "--global", "--add", "safe.directory", dataPath).Run()
+// fetch fetches the branch into the repository, the only step that uses the credentials
+func (c *Container) fetch(repository string, auth GitAuth, branch string) (err error) {
+	fetch, done, err := c.authenticated(auth, "--git-dir", repository, "fetch", "--progress", "--depth", "1", "--no-tags",
+		auth.remoteUrl(), "+refs/heads/"+branch+":"+deployedRef)
 	if err != nil {
-		log.Error("error while whitelisting repo")
 		return err
 	}
+	defer done()
+	out, err := fetch.CombinedOutput()
+	log.Info(string(out))
+	return err
+}
+
+// checkout checks the fetched commit out in the work tree, without credentials. Tracked files are replaced and
+// untracked ones removed, the ignored ones are kept. A .git directory left in the tree by the clones of earlier
+// versions is ignored
+func checkout(repository string, workTree string) (err error) {
+	for _, args := range [][]string{
+		{"checkout", "--quiet", "--force", "--detach", deployedRef},
+		{"clean", "-dff"},
+	} {
+		// the tree belongs to the tenant
+		cmd := gitCommand(append([]string{"-c", "safe.directory=" + workTree, "--git-dir", repository, "--work-tree", workTree}, args...)...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("git %s failed: %v: %s", args[0], err, out)
+		}
+	}
 	return nil
 }
 
-func (c *Container) Pull(cli *client.Client, token string, uri string, branch string, domain string) (err error) {
+func (c *Container) Pull(cli *client.Client, auth GitAuth, branch string) (err error) {
 	log.Info("pulling repository")
 	if c.ExpectingFirstCommit {
 		log.Info("pulling first commit")
@@ -93,149 +211,38 @@ func (c *Container) Pull(cli *client.Client, token string, uri string, branch st
 		}
 		shouldRestart = true
 	}
-	gitUrl := "https://x-access-token:" + token + "@" + domain + "/" + uri
-	isUpdated := false
-	dataPath := c.Dir()
 	if c.ExpectingFirstCommit {
 		shouldRestart = true
 	}
-	// check if git repo is initialized
-	isRepo, err := c.isGitRepository()
+	repository, err := c.repositoryDir()
 	if err != nil {
-		log.Error("error while checking if project is within a git repository: ", err)
 		return err
 	}
-	// if the repo is not initialized, we will first pull aside the data, perform a clone, and move data back
-	if !isRepo {
-		log.Info("the container is not on a github repository, initializing")
-		temporaryId, err := c.pullAside()
-		if err != nil {
-			return err
-		}
-		log.Info("initializing container")
-		out, err := exec.Command(
-			"git", "-C", dataPath, "clone", "--depth", "1", "-b", branch, gitUrl, ".",
-		).CombinedOutput()
-		log.Info(string(out))
-		if err != nil {
-			log.Error("error while initializing: ", err)
-			_ = c.bringTogether(temporaryId)
-			return err
-		}
-		err = c.bringTogether(temporaryId)
-		if err != nil {
-			return err
-		}
-		isUpdated = true
-	}
-	// clean repo
-	err = c.Whitelist()
+	log.Info("fetching changes")
+	err = c.fetch(repository, auth, branch)
 	if err != nil {
+		log.Info("error while fetching changes: ", err)
 		return err
 	}
-	log.Info("resetting repo")
-	err = exec.Command("git", "-C", dataPath, "reset", "--hard").Run()
-	if err != nil {
-		log.Error("error resetting repo: ", err)
-		return err
-	}
-	log.Info("cleaning up repo")
-	err = exec.Command("git", "-C", dataPath, "clean", "-dff").Run()
-	if err != nil {
-		log.Error("error cleaning up repo: ", err)
-		return err
-	}
-	if !isUpdated {
-		// update remote url (token)
-		log.Info("updating remote")
-		err = exec.Command("git", "-C", dataPath, "remote", "set-url", "origin", gitUrl).Run()
-		if err != nil {
-			log.Error("error while updating remote")
-			return err
-		}
-		// ensure correct branch
-		log.Info("checking out branch")
-		err = exec.Command("git", "-C", dataPath, "checkout", branch).Run()
-		if err != nil {
-			log.Error("error while checking out branch: ", err)
-			return err
-		}
-		// pull changes
-		log.Info("pulling changes")
-		err = exec.Command("git", "-C", dataPath, "pull", "--progress", "--rebase").Run()
-		if err != nil {
-			log.Info("error while pulling changes: ", err)
-			return err
-		}
-	}
-	// delete container to re-crease, just in case the .env file changed
-	err = c.deleteContainer(cli)
-	if err != nil {
-		return err
-	}
-	err = c.createContainer(cli)
+	log.Info("checking out changes")
+	err = checkout(repository, c.Dir())
 	if err != nil {
+		log.Error("error while checking out changes: ", err)
 		return err
 	}
 	err = c.ReadyFs()
 	if err != nil {
 		return err
 	}
+	// re-create the container, just in case the .env file changed
 	if shouldRestart {
-		log.Info("restarting the container to match the initial state before pull")
-		err = c.Start(cli)
-		if err != nil {
-			log.Error("error while restarting container: ", err)
-			return err
-		}
-	}
-	log.Info("finished pulling")
-	return err
-}
-
-func (c *Container) getTemporaryFolder(temporaryId string) string {
-	return filepath.Join(c.homeDir(), "tmp-"+temporaryId)
-}
-
-func (c *Container) pullAside() (temporaryId string, err error) {
-	log.Info("pulling aside")
-	temporaryId = randstr.Hex(8)
-	targetPath := c.getTemporaryFolder(temporaryId)
-	err = os.MkdirAll(targetPath, os.ModePerm)
-	if err != nil {
-		return "", err
-	}
-	originPath := c.Dir()
-	r, err := exec.Command("rsync", "-a", "--remove-source-files", c.appendSlash(originPath), targetPath).Output()
-	if err != nil {
-		log.Error("error while pulling aside, trying to bring together: ", string(r), ", ", err)
-		_ = c.bringTogether(temporaryId)
-		return "", err
+		log.Info("the container will be restarted to match the initial state before pull")
 	}
-	err = c.Clear()
-	return temporaryId, err
-}
-
-func (c *Container) bringTogether(temporaryId string) (err error) {
-	log.Info("bringing together aside")
-	temporaryDirectory := c.getTemporaryFolder(temporaryId)
-	originPath := c.Dir()
-	r, err := exec.Command("rsync", "-a", "--remove-source-files", "--ignore-existing", c.appendSlash(temporaryDirectory), originPath).Output()
+	// a rollback starts the previous container again when it should be restarted
+	err = c.createContainer(cli, shouldRestart)
 	if err != nil {
-		log.Error("error while bringing together: ", string(r), ", ", err)
 		return err
 	}
-	// cleanup
-	err = os.RemoveAll(temporaryDirectory)
-	if err != nil {
-		log.Error("error while cleaning after bringing together")
-	}
-	return err
-}
-
-func (c *Container) appendSlash(str string) string {
-	if len(str) == 0 || str[len(str)-1] != os.PathSeparator {
-		return str + string(os.PathSeparator)
-	}
-	return str
+	log.Info("finished pulling")
+	return nil
 }
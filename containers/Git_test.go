@@ -0,0 +1,111 @@
+package containers
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuthenticated(t *testing.T) {
+	c := Container{Id: "test"}
+	auth := GitAuth{Domain: "git.example.com", Token: "secret-token"}
+	for _, test := range []struct {
+		host     string
+		password string
+	}{
+		{"git.example.com", "secret-token"},
+		{"other.example.com", ""},
+	} {
+		cmd, done, err := c.authenticated(auth, "credential", "fill")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, env := range cmd.Env {
+			if strings.Contains(env, auth.Token) {
+				t.Errorf("token in the environment: %s", env)
+			}
+		}
+		for _, arg := range cmd.Args {
+			if strings.Contains(arg, auth.Token) {
+				t.Errorf("token in the arguments: %s", arg)
+			}
+		}
+		cmd.Stdin = strings.NewReader("protocol=https\nhost=" + test.host + "\n\n")
+		out, err := cmd.Output()
+		done()
+		if test.password == "" {
+			// no credential and no prompt, git gives up
+			if err == nil || strings.Contains(string(out), auth.Token) {
+				t.Errorf("%s: credentials given: %s", test.host, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.host, err)
+		}
+		if !strings.Contains(string(out), "username=x-access-token\n") || !strings.Contains(string(out), "password="+test.password+"\n") {
+			t.Errorf("%s: unexpected credentials: %s", test.host, out)
+		}
+	}
+}
+
+func TestCheckout(t *testing.T) {
+	source := t.TempDir()
+	repository := filepath.Join(t.TempDir(), "repository")
+	workTree := t.TempDir()
+	marker := filepath.Join(t.TempDir(), "marker")
+	run := func(cmd *exec.Cmd) {
+		t.Helper()
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v: %v: %s", cmd.Args, err, out)
+		}
+	}
+	write := func(path string, content string) {
+		t.Helper()
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = os.WriteFile(path, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(filepath.Join(source, "server.properties"), "port=1\n")
+	write(filepath.Join(source, ".gitattributes"), "* filter=evil\n")
+	write(filepath.Join(source, ".gitignore"), "world/\n")
+	run(gitCommand("init", "--quiet", "--initial-branch", "main", source))
+	run(gitCommand("-C", source, "add", "."))
+	run(gitCommand("-C", source, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "initial"))
+	run(gitCommand("init", "--quiet", "--bare", repository))
+	run(gitCommand("--git-dir", repository, "fetch", "--quiet", "--depth", "1", source, "+refs/heads/main:"+deployedRef))
+
+	// a clone of an earlier version, its config defines the filter the attributes ask for
+	write(filepath.Join(workTree, ".git", "config"), "[filter \"evil\"]\n\tsmudge = touch "+marker+"\n[core]\n\thooksPath = /nonexistent\n")
+	write(filepath.Join(workTree, "server.properties"), "port=2\n")
+	write(filepath.Join(workTree, "untracked"), "")
+	write(filepath.Join(workTree, "world", "level.dat"), "")
+
+	err := checkout(repository, workTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("the filter of the work tree ran")
+	}
+	content, err := os.ReadFile(filepath.Join(workTree, "server.properties"))
+	if err != nil || string(content) != "port=1\n" {
+		t.Errorf("tracked file not reset: %q, %v", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(workTree, "untracked")); err == nil {
+		t.Error("untracked file not cleaned")
+	}
+	for _, kept := range []string{filepath.Join("world", "level.dat"), filepath.Join(".git", "config")} {
+		if _, err := os.Stat(filepath.Join(workTree, kept)); err != nil {
+			t.Errorf("%s not kept: %v", kept, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package containers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the chain filtering the input of the host, its jump sits first in INPUT
+const hostChain = "serverbench-host"
+
+// traffic from these interfaces is always accepted, + matches any suffix. The docker bridges aren't, the
+// containers of the tenants reach the services of the host like any remote
+var hostInterfaces = []string{"lo"}
+
+// HostFirewall filters the traffic to the services of the machine itself (ssh, the sftp server on port 23...).
+// Established connections, ICMP and loopback are always accepted, then the admins, then the ports, and the
+// policy applies to the rest, the containers included
+type HostFirewall struct {
+	Admins []string `json:"admins"` // remotes allowed on every port
+	Ports  []Port   `json:"ports"`  // same layout as the container ports: the remotes get the opposite policy
+	Policy string   `json:"policy"` // drop or accept
+}
+
+func (h *HostFirewall) validate() error {
+	if h.Policy != Drop && h.Policy != Accept {
+		return fmt.Errorf("invalid host policy %q", h.Policy)
+	}
+	for _, admin := range h.Admins {
+		_, err := parseRemote(admin)
+		if err != nil {
+			return fmt.Errorf("%w for the admins", err)
+		}
+	}
+	for _, p := range h.Ports {
+		err := p.validate()
+		if err != nil {
+			return err
+		}
+		if p.Target != 0 {
+			return fmt.Errorf("host port %d can't have a target", p.Port)
+		}
+		if p.Limits != nil {
+			return fmt.Errorf("host port %d can't have limits", p.Port)
+		}
+		if len(p.Countries) > 0 {
+			return fmt.Errorf("host port %d can't have countries", p.Port)
+		}
+	}
+	return nil
+}
+
+// Install validates the host firewall and installs it in both address families
+func (h *HostFirewall) Install() error {
+	err := h.validate()
+	if err != nil {
+		return err
+	}
+	if os.Getenv("SKIP_IPTABLES") == "true" {
+		return nil
+	}
+	log.Info("installing host firewall")
+	for _, v6 := range []bool{false, true} {
+		err = firewallBackend().InstallHost(*h, v6)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UninstallHostFirewall removes the host firewall of both address families, the host accepts everything again
+func UninstallHostFirewall() error {
+	if os.Getenv("SKIP_IPTABLES") == "true" {
+		return nil
+	}
+	log.Info("uninstalling host firewall")
+	var errs []error
+	for _, v6 := range []bool{false, true} {
+		errs = append(errs, firewallBackend().UninstallHost(v6))
+	}
+	return errors.Join(errs...)
+}
+
+// HostFirewallState is the host firewall installed on the machine, persisted so a pending firewall is
+// reverted even when the daemon restarts before it's confirmed
+type HostFirewallState struct {
+	Installed *HostFirewall `json:"installed"` // nil when the host has no firewall
+	Previous  *HostFirewall `json:"previous"`  // restored when the installed one isn't confirmed in time
+	Deadline  *time.Time    `json:"deadline"`  // set while the installed firewall waits for its confirmation
+}
+
+func hostFirewallPath() (string, error) {
+	return StateDir("host-firewall.json")
+}
+
+// ReadHostFirewallState returns the persisted state, empty when no host firewall was ever installed
+func ReadHostFirewallState() (state HostFirewallState, err error) {
+	path, err := hostFirewallPath()
+	if err != nil {
+		return state, err
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(raw, &state)
+	return state, err
+}
+
+// WriteHostFirewallState persists the state
+func WriteHostFirewallState(state HostFirewallState) (err error) {
+	path, err := hostFirewallPath()
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// written aside and renamed, so a crash never leaves a truncated file
+	err = os.WriteFile(path+".tmp", raw, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,276 @@
+package containers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	log "github.com/sirupsen/logrus"
+)
+
+// layer states reported while pulling
+const (
+	LayerWaiting     = "waiting"
+	LayerDownloading = "downloading"
+	LayerDownloaded  = "downloaded"
+	LayerExtracting  = "extracting"
+	LayerComplete    = "complete"
+)
+
+// progress is reported at most once per interval, the final state is always reported
+const progressInterval = 500 * time.Millisecond
+
+// normalizes the docker pull statuses of a layer
+var layerStatuses = map[string]string{
+	"Pulling fs layer":   LayerWaiting,
+	"Waiting":            LayerWaiting,
+	"Downloading":        LayerDownloading,
+	"Verifying Checksum": LayerDownloaded,
+	"Download complete":  LayerDownloaded,
+	"Extracting":         LayerExtracting,
+	"Pull complete":      LayerComplete,
+	"Already exists":     LayerComplete,
+}
+
+type LayerProgress struct {
+	Id      string `json:"id"`
+	Status  string `json:"status"`
+	Current int64  `json:"current"` // bytes downloaded or extracted, depending on the status
+	Total   int64  `json:"total"`
+}
+
+// PullProgress aggregates the progress of every layer of an image pull
+type PullProgress struct {
+	Image   string          `json:"image"`
+	Status  string          `json:"status"`
+	Current int64           `json:"current"` // downloaded bytes across all layers
+	Total   int64           `json:"total"`   // known size across all layers
+	Layers  []LayerProgress `json:"layers"`
+	Done    bool            `json:"done"`
+}
+
+// ProgressFunc receives updates while an image is being pulled, it may be nil
+type ProgressFunc func(progress PullProgress)
+
+type pullTracker struct {
+	progress PullProgress
+	layers   map[string]int // index of each layer in progress.Layers
+	sizes    map[string]int64
+	report   ProgressFunc
+	reported time.Time
+}
+
+func (t *pullTracker) handle(msg jsonmessage.JSONMessage) {
+	status, ok := layerStatuses[msg.Status]
+	if msg.ID == "" || !ok {
+		// image level statuses, e.g. the final digest
+		if msg.Status != "" {
+			t.progress.Status = msg.Status
+		}
+		return
+	}
+	index, ok := t.layers[msg.ID]
+	if !ok {
+		index = len(t.progress.Layers)
+		t.layers[msg.ID] = index
+		t.progress.Layers = append(t.progress.Layers, LayerProgress{Id: msg.ID})
+	}
+	layer := &t.progress.Layers[index]
+	layer.Status = status
+	if msg.Progress != nil && msg.Progress.Total > 0 {
+		layer.Current = msg.Progress.Current
+		layer.Total = msg.Progress.Total
+		if status == LayerDownloading {
+			t.sizes[msg.ID] = msg.Progress.Total
+		}
+	} else if status == LayerComplete {
+		layer.Current = layer.Total
+	}
+	t.aggregate()
+}
+
+func (t *pullTracker) aggregate() {
+	t.progress.Current = 0
+	t.progress.Total = 0
+	for _, layer := range t.progress.Layers {
+		size := t.sizes[layer.Id]
+		t.progress.Total += size
+		switch layer.Status {
+		case LayerDownloading:
+			t.progress.Current += layer.Current
+		case LayerDownloaded, LayerExtracting, LayerComplete:
+			t.progress.Current += size
+		}
+	}
+}
+
+func (t *pullTracker) flush(force bool) {
+	if t.report == nil || (!force && time.Since(t.reported) < progressInterval) {
+		return
+	}
+	t.reported = time.Now()
+	snapshot := t.progress
+	snapshot.Layers = append([]LayerProgress(nil), t.progress.Layers...)
+	t.report(snapshot)
+}
+
+// readPullStream decodes the pull stream, failures reported inside the stream are returned as errors
+func readPullStream(stream io.Reader, ref string, report ProgressFunc) (err error) {
+	tracker := &pullTracker{
+		progress: PullProgress{
+			Image:  ref,
+			Layers: make([]LayerProgress, 0),
+		},
+		layers: make(map[string]int),
+		sizes:  make(map[string]int64),
+		report: report,
+	}
+	decoder := json.NewDecoder(stream)
+	for {
+		var msg jsonmessage.JSONMessage
+		err = decoder.Decode(&msg)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading image pull stream: %w", err)
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("error pulling image %s: %s", ref, msg.Error.Message)
+		}
+		if msg.ErrorMessage != "" {
+			return fmt.Errorf("error pulling image %s: %s", ref, msg.ErrorMessage)
+		}
+		tracker.handle(msg)
+		tracker.flush(false)
+	}
+	tracker.progress.Done = true
+	tracker.flush(true)
+	log.Info(tracker.progress.Status)
+	return nil
+}
+
+func (c *Container) pullImage(cli *client.Client, report ProgressFunc) (err error) {
+	log.Info("pulling image")
+	ref, err := c.imageRef()
+	if err != nil {
+		return err
+	}
+	return c.pull(cli, ref, report)
+}
+
+// pull pulls a reference with the registry credentials of the container and tracks it for garbage collection
+func (c *Container) pull(cli *client.Client, ref string, report ProgressFunc) (err error) {
+	auth, err := c.registryAuth(ref)
+	if err != nil {
+		return err
+	}
+	out, err := cli.ImagePull(context.Background(), ref, image.PullOptions{
+		RegistryAuth: auth,
+	})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	err = readPullStream(out, ref, report)
+	if err != nil {
+		return err
+	}
+	err = trackImage(cli, ref)
+	if err != nil {
+		// not fatal, the image just won't be garbage collected
+		log.Error("error while tracking image: ", err)
+	}
+	return nil
+}
+
+// TrackedImage is an image pulled by the daemon, only those are considered for garbage collection
+type TrackedImage struct {
+	Id       string    `json:"id"`
+	Refs     []string  `json:"refs"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+var trackerLock sync.Mutex
+
+func trackerPath() (string, error) {
+	return StateDir("images.json")
+}
+
+// TrackedImages returns the images pulled by the daemon, by image id
+func TrackedImages() (images map[string]TrackedImage, err error) {
+	trackerLock.Lock()
+	defer trackerLock.Unlock()
+	return readTracker()
+}
+
+func readTracker() (images map[string]TrackedImage, err error) {
+	images = make(map[string]TrackedImage)
+	path, err := trackerPath()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return images, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(raw, &images)
+	return images, err
+}
+
+func writeTracker(images map[string]TrackedImage) (err error) {
+	path, err := trackerPath()
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(images)
+	if err != nil {
+		return err
+	}
+	// written aside and renamed, so a crash never leaves a truncated file
+	err = os.WriteFile(path+".tmp", raw, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// UpdateTrackedImages applies the given changes to the tracked images atomically
+func UpdateTrackedImages(update func(images map[string]TrackedImage)) (err error) {
+	trackerLock.Lock()
+	defer trackerLock.Unlock()
+	images, err := readTracker()
+	if err != nil {
+		return err
+	}
+	update(images)
+	return writeTracker(images)
+}
+
+func trackImage(cli *client.Client, ref string) (err error) {
+	inspect, err := cli.ImageInspect(context.Background(), ref)
+	if err != nil {
+		return err
+	}
+	return UpdateTrackedImages(func(images map[string]TrackedImage) {
+		tracked := images[inspect.ID]
+		tracked.Id = inspect.ID
+		tracked.LastUsed = time.Now()
+		if !slices.Contains(tracked.Refs, ref) {
+			tracked.Refs = append(tracked.Refs, ref)
+		}
+		images[inspect.ID] = tracked
+	})
+}
@@ -0,0 +1,266 @@
+package containers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	log "github.com/sirupsen/logrus"
+)
+
+// the installer lives next to sb-<id> while the install script runs
+const installSuffix = ".install"
+
+// where the container directory is mounted in the installer
+const installerMount = "/mnt/server"
+
+const defaultInterpreter = "sh"
+
+// InstallScript prepares the container directory (downloads, builds...) in a throwaway container
+type InstallScript struct {
+	Image       string `json:"image"`       // provides the tools the script needs, e.g. curl
+	Interpreter string `json:"interpreter"` // runs the script with -c, sh by default
+	Script      string `json:"script"`
+}
+
+// OutputFunc receives the install script output line by line, it may be nil
+type OutputFunc func(line string)
+
+func (s *InstallScript) validate() error {
+	if s.Image == "" {
+		return errors.New("the install script has no image")
+	}
+	if strings.TrimSpace(s.Script) == "" {
+		return errors.New("the install script is empty")
+	}
+	return nil
+}
+
+// lineWriter calls output once per complete line
+type lineWriter struct {
+	output  OutputFunc
+	pending []byte
+}
+
+func (w *lineWriter) Write(p []byte) (n int, err error) {
+	w.pending = append(w.pending, p...)
+	for {
+		end := bytes.IndexByte(w.pending, '\n')
+		if end < 0 {
+			return len(p), nil
+		}
+		w.output(strings.TrimSuffix(string(w.pending[:end]), "\r"))
+		w.pending = w.pending[end+1:]
+	}
+}
+
+func (w *lineWriter) flush() {
+	if len(w.pending) > 0 {
+		w.output(string(w.pending))
+		w.pending = nil
+	}
+}
+
+func installMarker(id string) (path string, err error) {
+	dir, err := StateDir("installed")
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, id), nil
+}
+
+// Installed reports whether the install script of the container already succeeded
+func (c *Container) Installed() bool {
+	marker, err := installMarker(c.Id)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(marker)
+	return err == nil
+}
+
+func (c *Container) forgetInstall() (err error) {
+	marker, err := installMarker(c.Id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(marker)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (c *Container) removeInstaller(ctx context.Context, cli *client.Client) (err error) {
+	cid, err := c.findByName(cli, c.cName()+installSuffix)
+	if errors.Is(err, unknownContainer) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return cli.ContainerRemove(ctx, cid, container.RemoveOptions{Force: true})
+}
+
+// Install runs the install script of the template against the container directory, then applies the config
+// rewrites. The main container must be stopped, the script rewrites the files it runs from
+func (c *Container) Install(cli *client.Client, output OutputFunc) (err error) {
+	if c.Template == nil || c.Template.Install == nil {
+		return errors.New("the container has no install script")
+	}
+	running, err := c.Running(cli)
+	if err != nil {
+		return err
+	}
+	if running {
+		return errors.New("the container must be stopped before the install script runs")
+	}
+	err = c.applyTemplate()
+	if err != nil {
+		return err
+	}
+	if output == nil {
+		output = func(line string) {
+			log.Info("install: ", line)
+		}
+	}
+	err = c.ReadyFs()
+	if err != nil {
+		return err
+	}
+	script := c.Template.Install
+	log.Info("running install script")
+	err = c.pull(cli, script.Image, nil)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	err = c.removeInstaller(ctx, cli)
+	if err != nil {
+		return err
+	}
+	hostPath, err := c.HostDir(cli)
+	if err != nil {
+		return err
+	}
+	interpreter := script.Interpreter
+	if interpreter == "" {
+		interpreter = defaultInterpreter
+	}
+	hostConfig := &container.HostConfig{
+		Mounts: []mount.Mount{
+			{
+				Type:   mount.TypeBind,
+				Source: *hostPath,
+				Target: installerMount,
+			},
+		},
+	}
+	if c.Memory != nil && *c.Memory > 0 {
+		hostConfig.Memory = *c.Memory
+	}
+	// the installer runs as root on the default bridge, the files are handed over to the tenant afterwards
+	installer, err := cli.ContainerCreate(ctx, &container.Config{
+		Image:      script.Image,
+		Env:        c.environment(),
+		Entrypoint: []string{interpreter, "-c"},
+		Cmd:        []string{strings.ReplaceAll(script.Script, "\r\n", "\n")},
+		WorkingDir: installerMount,
+	}, hostConfig, nil, nil, c.cName()+installSuffix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		removeErr := cli.ContainerRemove(context.Background(), installer.ID, container.RemoveOptions{Force: true})
+		if removeErr != nil {
+			log.Error("error removing installer: ", removeErr)
+		}
+	}()
+	// registered before starting, so the exit can't be missed
+	waitC, waitErrC := cli.ContainerWait(ctx, installer.ID, container.WaitConditionNextExit)
+	err = cli.ContainerStart(ctx, installer.ID, container.StartOptions{})
+	if err != nil {
+		return err
+	}
+	logs, err := cli.ContainerLogs(ctx, installer.ID, container.LogsOptions{
+		Follow:     true,
+		ShowStdout: true,
+		ShowStderr: true,
+	})
+	if err != nil {
+		return err
+	}
+	writer := &lineWriter{output: output}
+	_, err = stdcopy.StdCopy(writer, writer, logs)
+	logs.Close()
+	writer.flush()
+	if err != nil {
+		return err
+	}
+	select {
+	case result := <-waitC:
+		if result.Error != nil {
+			return errors.New(result.Error.Message)
+		}
+		if result.StatusCode != 0 {
+			return fmt.Errorf("install script exited with code %d", result.StatusCode)
+		}
+	case err = <-waitErrC:
+		return err
+	}
+	err, perm := c.PermSnippet()
+	if err != nil {
+		return err
+	}
+	err = exec.Command("chown", "-R", perm, c.Dir()).Run()
+	if err != nil {
+		return err
+	}
+	marker, err := installMarker(c.Id)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(marker, nil, 0600)
+	if err != nil {
+		return err
+	}
+	return c.rewriteConfigs()
+}
+
+// Reinstall stops the container, runs the install script again and recreates the container, which is
+// started again if it was running
+func (c *Container) Reinstall(cli *client.Client, output OutputFunc, report ProgressFunc) (err error) {
+	status, statusErr := c.getStatus(cli, nil, nil)
+	wasRunning := statusErr == nil && (status == "running" || status == "restarting")
+	if wasRunning {
+		err = c.Stop(cli)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Install(cli, output)
+	if err != nil {
+		return err
+	}
+	err = c.Update(cli, false, report)
+	if err != nil {
+		return err
+	}
+	if wasRunning {
+		return c.Start(cli)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package containers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var ipsetWrapper = "/wrapper/ipset"
+
+// ports with more remotes than this (in a family) get an ipset, fewer are matched rule by rule
+const ipsetThreshold = 8
+
+// hash sets allocate as they grow, the limit only needs to fit the largest allowlists
+const ipsetMaxElements = 1 << 20
+
+func ipset(stdin string, args ...string) error {
+	cmd := exec.Command(ipsetWrapper, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ipset %v failed: %v: %s", args, err, stderr.String())
+	}
+	return nil
+}
+
+// ipsetPrefix namespaces the sets of a chain and family. ipset names are limited to 31 characters, so the
+// chain is hashed
+func ipsetPrefix(f Firewall) string {
+	sum := sha256.Sum256([]byte(f.Chain))
+	family := "4"
+	if f.IPv6 {
+		family = "6"
+	}
+	return "sb-" + hex.EncodeToString(sum[:])[:10] + "-" + family + "-"
+}
+
+// the names of the sets of every chain, see ipsetPrefix, with the temporary ones of ipsetReplace. Sets used
+// to be named after the index of their port
+var ipsetPattern = regexp.MustCompile(`^sb-[0-9a-f]{10}-([46])-([0-9a-f]{12}|\d+)(-t)?$`)
+
+// ipsetName names the set after its remotes: a set is only ever refilled with the remotes it already holds,
+// so the live chain keeps matching the right remotes until the shadow chain, with its own sets, replaces it
+func ipsetName(f Firewall, remotes []string) string {
+	sorted := slices.Clone(remotes)
+	slices.Sort(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, ",")))
+	return ipsetPrefix(f) + hex.EncodeToString(sum[:])[:12]
+}
+
+// ipsetEntries converts the remotes into hash:net entries, which can't hold a /0
+func ipsetEntries(remotes []string) (entries []string, err error) {
+	for _, remote := range remotes {
+		prefix, err := parseRemote(remote)
+		if err != nil {
+			return nil, err
+		}
+		if prefix.Bits() > 0 {
+			entries = append(entries, prefix.String())
+			continue
+		}
+		lower := netip.PrefixFrom(prefix.Addr(), 1)
+		upper := netip.PrefixFrom(lastAddress(prefix), 1).Masked()
+		entries = append(entries, lower.String(), upper.String())
+	}
+	return entries, nil
+}
+
+// ipsetReplace fills a temporary set and swaps it with the live one, the rules referencing the set see
+// either the old or the new remotes
+func ipsetReplace(name string, v6 bool, remotes []string) (err error) {
+	entries, err := ipsetEntries(remotes)
+	if err != nil {
+		return err
+	}
+	if len(entries) > ipsetMaxElements {
+		return fmt.Errorf("too many remotes: %d", len(entries))
+	}
+	family := "inet"
+	if v6 {
+		family = "inet6"
+	}
+	temporary := name + "-t"
+	// left behind by an interrupted replace
+	_ = ipset("", "destroy", temporary)
+	var script strings.Builder
+	for _, set := range []string{name, temporary} {
+		fmt.Fprintf(&script, "create %s hash:net family %s maxelem %d -exist\n", set, family, ipsetMaxElements)
+	}
+	for _, entry := range entries {
+		fmt.Fprintf(&script, "add %s %s -exist\n", temporary, entry)
+	}
+	fmt.Fprintf(&script, "swap %s %s\n", temporary, name)
+	fmt.Fprintf(&script, "destroy %s\n", temporary)
+	log.Info("replacing ipset ", name, " with ", len(entries), " entries")
+	return ipset(script.String(), "restore")
+}
+
+// ipsetExists reports whether the set exists
+func ipsetExists(name string) bool {
+	return ipset("", "list", "-n", name) == nil
+}
+
+// ipsetOutput runs ipset and returns its output
+func ipsetOutput(args ...string) (out []byte, err error) {
+	cmd := exec.Command(ipsetWrapper, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err = cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ipset %v failed: %v: %s", args, err, stderr.String())
+	}
+	return out, nil
+}
+
+// ipsetSets returns the sets of the firewall
+func ipsetSets(f Firewall) (names []string, err error) {
+	out, err := ipsetOutput("list", "-n")
+	if err != nil {
+		return nil, err
+	}
+	prefix := ipsetPrefix(f)
+	for _, name := range strings.Fields(string(out)) {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// ipsetMembers returns the entries of the set, none when it doesn't exist
+func ipsetMembers(name string) (members []string, err error) {
+	if !ipsetExists(name) {
+		return nil, nil
+	}
+	out, err := ipsetOutput("save", name)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "add" {
+			continue
+		}
+		// listed without the mask when it's a single address, as entries are added with it
+		prefix, err := parseRemote(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, prefix.String())
+	}
+	return members, nil
+}
+
+// ipsetCollect destroys the sets of the firewall that aren't used anymore, the rules referencing them
+// must be gone already
+func ipsetCollect(f Firewall, used []string) (err error) {
+	names, err := ipsetSets(f)
+	if err != nil {
+		if len(used) == 0 {
+			// hosts without ipset support are fine as long as no port needs a set
+			log.Info("unable to list ipsets: ", err)
+			return nil
+		}
+		return err
+	}
+	for _, name := range names {
+		if !slices.Contains(used, name) {
+			log.Info("destroying unused ipset ", name)
+			err = ipset("", "destroy", name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ipsetCollectStale destroys the sets of the family that don't belong to a kept chain, the rules
+// referencing them must be gone already
+func ipsetCollectStale(v6 bool, keep []string) (err error) {
+	out, err := ipsetOutput("list", "-n")
+	if err != nil {
+		log.Info("unable to list ipsets: ", err)
+		return nil
+	}
+	family := "4"
+	if v6 {
+		family = "6"
+	}
+	prefixes := make([]string, 0, len(keep))
+	for _, chain := range keep {
+		prefixes = append(prefixes, ipsetPrefix(Firewall{Chain: chain, IPv6: v6}))
+	}
+	for _, name := range strings.Fields(string(out)) {
+		match := ipsetPattern.FindStringSubmatch(name)
+		if match == nil || match[1] != family {
+			continue
+		}
+		kept := slices.ContainsFunc(prefixes, func(prefix string) bool {
+			return strings.HasPrefix(name, prefix)
+		})
+		if kept {
+			continue
+		}
+		log.Info("destroying stale ipset ", name)
+		err = ipset("", "destroy", name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package containers
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestIpsetName(t *testing.T) {
+	f := Firewall{Chain: chainPrefix + "0123456789abcdef0123456789abcdef"}
+	name := ipsetName(f, []string{"198.51.100.1", "198.51.100.0/24"})
+	if reordered := ipsetName(f, []string{"198.51.100.0/24", "198.51.100.1"}); reordered != name {
+		t.Errorf("reordered remotes are named %s, expected %s", reordered, name)
+	}
+	if other := ipsetName(f, []string{"198.51.100.1"}); other == name {
+		t.Errorf("other remotes share the set %s", name)
+	}
+	if v6 := ipsetName(Firewall{Chain: f.Chain, IPv6: true}, []string{"198.51.100.1", "198.51.100.0/24"}); v6 == name {
+		t.Errorf("both families share the set %s", name)
+	}
+	for _, set := range []string{name, name + "-t", ipsetPrefix(f) + "0"} {
+		if len(set) > 31 {
+			t.Errorf("%s is longer than 31 characters", set)
+		}
+		if !ipsetPattern.MatchString(set) {
+			t.Errorf("%s doesn't match the set pattern", set)
+		}
+	}
+}
+
+func TestPlanKey(t *testing.T) {
+	b := iptablesBackend{}
+	f := Firewall{Chain: chainPrefix + "web"}
+	before := ipsetName(f, []string{"198.51.100.0/24"})
+	after := ipsetName(f, []string{"198.51.100.0/24", "203.0.113.0/24"})
+	rule := `-p tcp -m conntrack --ctorigdst 192.0.2.1/32 --ctorigdstport 25565 --ctdir REPLY -m set --match-set %s dst -m comment --comment "remote 25565/tcp" -j ACCEPT`
+	installed, desired := fmt.Sprintf(rule, before), fmt.Sprintf(rule, after)
+	if set := ruleSet(installed); set != before {
+		t.Errorf("the rule matches %q, expected %s", set, before)
+	}
+	if ruleSet("-p tcp --dport 22 -j ACCEPT") != "" {
+		t.Error("a rule without set matches a set")
+	}
+	if b.planKey(installed) != b.planKey(desired) {
+		t.Error("an allowlist edit replaces the rule")
+	}
+	if b.planKey(installed) == b.planKey(strings.Replace(desired, "25565", "25566", 2)) {
+		t.Error("the rules of another port compare equal")
+	}
+}
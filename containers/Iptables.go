@@ -0,0 +1,725 @@
+package containers
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/coreos/go-iptables/iptables"
+	log "github.com/sirupsen/logrus"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	table     = "filter"
+	forward   = "serverbench"
+	tlForward = "DOCKER-USER"
+	input     = "INPUT"
+)
+
+// the comment match as listed with the rule options
+var commentPattern = regexp.MustCompile(`/\* (.*?) \*/`)
+
+// the wrappers run iptables in the host network namespace, tests point them at plain binaries
+var (
+	ipv4Wrapper = "/wrapper/iptables"
+	ipv6Wrapper = "/wrapper/ip6tables"
+)
+
+func nsenterIptables(args ...string) error {
+	cmdArgs := append([]string{"--net=" + hostNetNS, "iptables"}, args...)
+	cmd := exec.Command("nsenter", cmdArgs...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("iptables %v failed: %v: %s", args, err, stderr.String())
+	}
+	return nil
+}
+
+// iptablesBackend manages the chains through the iptables wrappers, which run in the host network namespace
+type iptablesBackend struct{}
+
+func (b iptablesBackend) Name() string {
+	return BackendIptables
+}
+
+func (b iptablesBackend) iptables(v6 bool) (*iptables.IPTables, error) {
+	path := ipv4Wrapper
+	if v6 {
+		path = ipv6Wrapper
+	}
+	return iptables.New(iptables.Path(path))
+}
+
+// the shadow chain is filled while the live one keeps filtering, ids never contain dots. Chain names are
+// limited to 28 characters, hence the short suffix
+const shadowSuffix = ".n"
+
+// Install builds the rules in a shadow chain, then swaps the jumps: the new jump is inserted before the
+// old one is deleted, so the traffic is always filtered by a complete chain
+func (b iptablesBackend) Install(f Firewall) (err error) {
+	ipt, err := b.iptables(f.IPv6)
+	if err != nil {
+		return err
+	}
+	err = b.ensureParentChain(ipt)
+	if err != nil {
+		return err
+	}
+	log.Info("installing chain")
+	used := make([]string, 0)
+	err = b.swapChain(ipt, forward, f.Chain, func(shadow string) error {
+		for i, port := range f.Ports {
+			set, err := b.securePort(ipt, f, shadow, port, i)
+			if err != nil {
+				return err
+			}
+			if set != "" {
+				used = append(used, set)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// sets of removed ports (or ports whose remotes went under the threshold) aren't referenced anymore
+	return ipsetCollect(f, used)
+}
+
+// swapChain fills the shadow chain of the chain, then puts it in place of the chain
+func (b iptablesBackend) swapChain(ipt *iptables.IPTables, parent string, chain string, fill func(shadow string) error) (err error) {
+	err = b.recoverShadow(ipt, parent, chain)
+	if err != nil {
+		return err
+	}
+	shadow := chain + shadowSuffix
+	err = ipt.NewChain(table, shadow)
+	if err != nil {
+		return err
+	}
+	err = fill(shadow)
+	if err != nil {
+		return err
+	}
+	err = b.swapJump(ipt, parent, chain, shadow)
+	if err != nil {
+		return err
+	}
+	exists, err := ipt.ChainExists(table, chain)
+	if err != nil {
+		return err
+	}
+	if exists {
+		err = ipt.ClearAndDeleteChain(table, chain)
+		if err != nil {
+			return err
+		}
+	}
+	// renaming keeps the jump, which follows the chain
+	return ipt.RenameChain(table, shadow, chain)
+}
+
+// jumpPosition returns the rule number of the jump to the chain in the parent chain, 0 when missing
+func (b iptablesBackend) jumpPosition(ipt *iptables.IPTables, parent string, chain string) (position int, err error) {
+	rules, err := ipt.List(table, parent)
+	if err != nil {
+		return 0, err
+	}
+	// the first line is the chain declaration, so the index is the rule number
+	for i, rule := range rules {
+		if rule == "-A "+parent+" -j "+chain {
+			return i, nil
+		}
+	}
+	return 0, nil
+}
+
+// swapJump points the jump to from at to instead, at the same position. Without a jump to from, the jump
+// to to is inserted first
+func (b iptablesBackend) swapJump(ipt *iptables.IPTables, parent string, from string, to string) (err error) {
+	position, err := b.jumpPosition(ipt, parent, from)
+	if err != nil {
+		return err
+	}
+	if position == 0 {
+		return ipt.Insert(table, parent, 1, "-j", to)
+	}
+	err = ipt.Insert(table, parent, position, "-j", to)
+	if err != nil {
+		return err
+	}
+	return ipt.DeleteIfExists(table, parent, "-j", from)
+}
+
+// recoverShadow finishes or discards the swap of an interrupted install
+func (b iptablesBackend) recoverShadow(ipt *iptables.IPTables, parent string, chain string) (err error) {
+	shadow := chain + shadowSuffix
+	exists, err := ipt.ChainExists(table, shadow)
+	if err != nil || !exists {
+		return err
+	}
+	position, err := b.jumpPosition(ipt, parent, shadow)
+	if err != nil {
+		return err
+	}
+	if position == 0 {
+		log.Info("discarding incomplete shadow chain")
+		return ipt.ClearAndDeleteChain(table, shadow)
+	}
+	log.Info("completing interrupted chain swap")
+	err = ipt.DeleteIfExists(table, parent, "-j", chain)
+	if err != nil {
+		return err
+	}
+	live, err := ipt.ChainExists(table, chain)
+	if err != nil {
+		return err
+	}
+	if live {
+		err = ipt.ClearAndDeleteChain(table, chain)
+		if err != nil {
+			return err
+		}
+	}
+	return ipt.RenameChain(table, shadow, chain)
+}
+
+// Uninstall removes the chain of the container, nothing is created on the way: the chain or even the parent
+// chain may be missing, e.g. in a family the container never had rules for
+func (b iptablesBackend) Uninstall(f Firewall) (err error) {
+	log.Info("uninstalling chain")
+	ipt, err := b.iptables(f.IPv6)
+	if err != nil {
+		return err
+	}
+	parent, err := ipt.ChainExists(table, forward)
+	if err != nil {
+		return err
+	}
+	if parent {
+		err = b.recoverShadow(ipt, forward, f.Chain)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.deleteChain(ipt, f, parent)
+	if err != nil {
+		return err
+	}
+	return ipsetCollect(f, nil)
+}
+
+// Collect uninstalls the container chains, shadow ones included, whose live chain isn't kept, then the sets
+// left without a chain
+func (b iptablesBackend) Collect(v6 bool, keep []string) (removed []string, err error) {
+	ipt, err := b.iptables(v6)
+	if err != nil {
+		return nil, err
+	}
+	chains, err := ipt.ListChains(table)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range chains {
+		chain := strings.TrimSuffix(name, shadowSuffix)
+		if !strings.HasPrefix(chain, chainPrefix) || slices.Contains(keep, chain) || slices.Contains(removed, chain) {
+			continue
+		}
+		log.Info("collecting orphaned chain ", chain)
+		err = b.Uninstall(Firewall{Chain: chain, IPv6: v6})
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, chain)
+	}
+	return removed, ipsetCollectStale(v6, keep)
+}
+
+// Teardown collects every container chain, then removes the parent chain and its jump from DOCKER-USER,
+// and the host chain
+func (b iptablesBackend) Teardown() error {
+	for _, v6 := range []bool{false, true} {
+		_, err := b.Collect(v6, nil)
+		if err != nil {
+			return err
+		}
+		err = b.UninstallHost(v6)
+		if err != nil {
+			return err
+		}
+		ipt, err := b.iptables(v6)
+		if err != nil {
+			return err
+		}
+		// gone along with docker
+		exists, err := ipt.ChainExists(table, tlForward)
+		if err != nil {
+			return err
+		}
+		if exists {
+			err = ipt.DeleteIfExists(table, tlForward, "-j", forward)
+			if err != nil {
+				return fmt.Errorf("failed to remove jump rule from %s: %w", tlForward, err)
+			}
+		}
+		exists, err = ipt.ChainExists(table, forward)
+		if err != nil {
+			return err
+		}
+		if exists {
+			log.Info("deleting parent chain")
+			err = ipt.ClearAndDeleteChain(table, forward)
+			if err != nil {
+				return fmt.Errorf("failed to delete parent chain: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// deleteChain removes the jump to the chain and the chain if they exist, a shadow chain is only left over
+// when the parent chain is missing
+func (b iptablesBackend) deleteChain(ipt *iptables.IPTables, f Firewall, parent bool) error {
+	log.Info("deleting chain rules")
+	if parent {
+		err := ipt.DeleteIfExists(table, forward, "-j", f.Chain)
+		if err != nil {
+			return fmt.Errorf("failed to remove jump rule from %s: %w", forward, err)
+		}
+	}
+	for _, chain := range []string{f.Chain + shadowSuffix, f.Chain} {
+		exists, err := ipt.ChainExists(table, chain)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		err = ipt.ClearAndDeleteChain(table, chain)
+		if err != nil {
+			return fmt.Errorf("failed to delete chain %s: %w", chain, err)
+		}
+	}
+	return nil
+}
+
+// portSet returns the ipset holding the remotes of the port, empty when they're matched rule by rule
+func (b iptablesBackend) portSet(f Firewall, port Port) string {
+	if remotes := port.remotes(f.IPv6); len(remotes) > ipsetThreshold {
+		return ipsetName(f, remotes)
+	}
+	return ""
+}
+
+// countedRule returns the spec of a rule commented for its counters. Drops are logged first when enabled,
+// by a rule without comment so it isn't counted twice
+func (b iptablesBackend) countedRule(f Firewall, match []string, comment string, target string) (rules [][]string) {
+	if group, enabled := nflogGroup(); enabled && target == Drop {
+		logMatch := slices.Clone(match)
+		// the log rule has its own rate buckets, with the same parameters they take the same decisions
+		if i := slices.Index(logMatch, "--hashlimit-name"); i >= 0 {
+			logMatch[i+1] += "l"
+		}
+		rules = append(rules, append(logMatch, "-m", "limit", "--limit", fmt.Sprintf("%d/sec", nflogRate), "--limit-burst", strconv.Itoa(nflogBurst),
+			"-j", "NFLOG", "--nflog-group", strconv.Itoa(int(group)), "--nflog-prefix", nflogPrefix(f, comment), "--nflog-size", strconv.Itoa(nflogSnaplen)))
+	}
+	return append(rules, append(slices.Clone(match), "-m", "comment", "--comment", comment, "-j", target))
+}
+
+// limitRules returns the rule specs dropping the new connections above the limits of the port
+func (b iptablesBackend) limitRules(f Firewall, port Port, index int, address string, protocol string) (rules [][]string) {
+	limits := port.Limits
+	if limits == nil {
+		return nil
+	}
+	match := []string{"-p", protocol, "-m", "conntrack", "--ctstate", "NEW", "--ctorigdst", address, "--ctorigdstport", port.portMatch()}
+	if limits.Rate > 0 {
+		rules = append(rules, b.countedRule(f, append(slices.Clone(match),
+			"-m", "hashlimit", "--hashlimit-above", fmt.Sprintf("%d/sec", limits.Rate), "--hashlimit-burst", strconv.Itoa(limits.burst()),
+			"--hashlimit-mode", "srcip", "--hashlimit-name", hashlimitName(f, index, limits)),
+			ruleComment(RuleRateLimit, port, protocol), Drop)...)
+	}
+	if limits.Connections > 0 {
+		mask := "32"
+		if f.IPv6 {
+			mask = "128"
+		}
+		rules = append(rules, b.countedRule(f, append(slices.Clone(match),
+			"-m", "connlimit", "--connlimit-above", strconv.Itoa(limits.Connections), "--connlimit-mask", mask, "--connlimit-saddr"),
+			ruleComment(RuleConnectionLimit, port, protocol), Drop)...)
+	}
+	return rules
+}
+
+// portRules returns the rule specs of a port: the limits, the remotes (with the opposite policy), then the port
+// policy
+func (b iptablesBackend) portRules(f Firewall, port Port, index int, set string) (rules [][]string) {
+	var unmatchPolicy string
+	if port.Policy == Drop {
+		unmatchPolicy = Accept
+	} else {
+		unmatchPolicy = Drop
+	}
+	for _, address := range f.Addresses {
+		for _, protocol := range port.protocols() {
+			rules = append(rules, b.limitRules(f, port, index, address, protocol)...)
+		}
+		for _, protocol := range port.protocols() {
+			match := []string{"-p", protocol, "-m", "conntrack", "--ctorigdst", address, "--ctorigdstport", port.portMatch()}
+			remote := ruleComment(RuleRemote, port, protocol)
+			if set != "" {
+				// the set matches the packet addresses, not the conntrack ones: the remote is the source of the
+				// original direction and the destination of the replies
+				rules = append(rules, b.countedRule(f, append(slices.Clone(match), "--ctdir", "ORIGINAL", "-m", "set", "--match-set", set, "src"), remote, unmatchPolicy)...)
+				rules = append(rules, b.countedRule(f, append(slices.Clone(match), "--ctdir", "REPLY", "-m", "set", "--match-set", set, "dst"), remote, unmatchPolicy)...)
+			} else {
+				for _, source := range port.remotes(f.IPv6) {
+					remoteMatch := []string{"-p", protocol, "-m", "conntrack", "--ctorigsrc", source, "--ctorigdst", address, "--ctorigdstport", port.portMatch()}
+					rules = append(rules, b.countedRule(f, remoteMatch, remote, unmatchPolicy)...)
+				}
+			}
+		}
+		for _, protocol := range port.protocols() {
+			match := []string{"-p", protocol, "-m", "conntrack", "--ctorigdst", address, "--ctorigdstport", port.portMatch()}
+			rules = append(rules, b.countedRule(f, match, ruleComment(RulePolicy, port, protocol), port.Policy)...)
+		}
+	}
+	return rules
+}
+
+// creates the rules for securing that port in the chain, the sets are named after the firewall chain
+func (b iptablesBackend) securePort(ipt *iptables.IPTables, f Firewall, chain string, port Port, index int) (set string, err error) {
+	log.Info("securing port")
+	set = b.portSet(f, port)
+	if set != "" {
+		err = ipsetReplace(set, f.IPv6, port.remotes(f.IPv6))
+		if err != nil {
+			return "", err
+		}
+	}
+	for _, rule := range b.portRules(f, port, index, set) {
+		err = ipt.AppendUnique(table, chain, rule...)
+		if err != nil {
+			return "", err
+		}
+	}
+	log.Info("secured port")
+	return set, nil
+}
+
+// Check compares the chains with the firewall. Only the rules are compared for ipsets, their content is
+// replaced along with the rules
+func (b iptablesBackend) Check(f Firewall) (drift []string, err error) {
+	ipt, err := b.iptables(f.IPv6)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := ipt.ChainExists(table, f.Chain)
+	if err != nil {
+		return nil, err
+	}
+	// a family without addresses needs no chain at all, not even the parent one
+	if len(f.Addresses) == 0 {
+		if exists {
+			drift = append(drift, "unexpected chain "+f.Chain)
+		}
+		return drift, nil
+	}
+	parent, err := ipt.ChainExists(table, forward)
+	if err != nil {
+		return nil, err
+	}
+	if !parent {
+		drift = append(drift, "missing chain "+forward)
+	} else {
+		jump, err := ipt.Exists(table, tlForward, "-j", forward)
+		if err != nil {
+			return nil, err
+		}
+		if !jump {
+			drift = append(drift, "missing jump from "+tlForward+" to "+forward)
+		}
+	}
+	if !exists {
+		return append(drift, "missing chain "+f.Chain), nil
+	}
+	if parent {
+		position, err := b.jumpPosition(ipt, forward, f.Chain)
+		if err != nil {
+			return nil, err
+		}
+		if position == 0 {
+			drift = append(drift, "missing jump from "+forward+" to "+f.Chain)
+		}
+	}
+	expected := make(map[string]struct{})
+	for i, port := range f.Ports {
+		set := b.portSet(f, port)
+		if set != "" && !ipsetExists(set) {
+			drift = append(drift, "missing ipset "+set)
+			continue
+		}
+		for _, rule := range b.portRules(f, port, i, set) {
+			spec := strings.Join(rule, " ")
+			if _, ok := expected[spec]; ok {
+				continue
+			}
+			expected[spec] = struct{}{}
+			found, err := ipt.Exists(table, f.Chain, rule...)
+			if err != nil {
+				return nil, err
+			}
+			if !found {
+				drift = append(drift, "missing rule "+spec)
+			}
+		}
+	}
+	rules, err := ipt.List(table, f.Chain)
+	if err != nil {
+		return nil, err
+	}
+	// the first line is the chain declaration
+	if extra := len(rules) - 1 - len(expected); extra > 0 {
+		drift = append(drift, fmt.Sprintf("%d unexpected rules in %s", extra, f.Chain))
+	}
+	return drift, nil
+}
+
+// Counters sums the counters of the commented rules of the chain
+func (b iptablesBackend) Counters(f Firewall) (counters []Counter, err error) {
+	ipt, err := b.iptables(f.IPv6)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := ipt.StructuredStats(table, f.Chain)
+	if err != nil {
+		return nil, err
+	}
+	counters = make([]Counter, 0)
+	for _, stat := range stats {
+		match := commentPattern.FindStringSubmatch(stat.Options)
+		if match == nil {
+			continue
+		}
+		counter, ok := parseRuleComment(match[1])
+		if !ok {
+			continue
+		}
+		counter.Packets, counter.Bytes = stat.Packets, stat.Bytes
+		counters = addCounter(counters, counter)
+	}
+	return counters, nil
+}
+
+// ruleKey normalizes a rule for comparisons: iptables lists single addresses as /32 or /128 and leaves the
+// defaults out. Option order doesn't matter for our rules
+func (b iptablesBackend) ruleKey(rule string) string {
+	words := splitRule(rule)
+	key := make([]string, 0, len(words))
+	for i := 0; i < len(words); i++ {
+		if words[i] == "--hashlimit-burst" && i+1 < len(words) && words[i+1] == "5" {
+			i++
+			continue
+		}
+		word := strings.TrimSuffix(strings.TrimSuffix(words[i], "/32"), "/128")
+		key = append(key, word)
+	}
+	slices.Sort(key)
+	return strings.Join(key, " ")
+}
+
+// ruleSet returns the ipset a rule matches, empty when it matches none
+func ruleSet(rule string) string {
+	words := splitRule(rule)
+	i := slices.Index(words, "--match-set")
+	if i < 0 || i+1 >= len(words) {
+		return ""
+	}
+	return words[i+1]
+}
+
+// planKey is the ruleKey of a rule without its ipset. Sets are named after their remotes, a rule whose
+// remotes changed stays in place, only the elements of its set change
+func (b iptablesBackend) planKey(rule string) string {
+	words := splitRule(rule)
+	if i := slices.Index(words, "--match-set"); i >= 0 && i+1 < len(words) {
+		words[i+1] = "@set"
+	}
+	return b.ruleKey(joinRule(words))
+}
+
+// Plan lists the rules of the chain and compares them with the ones Install would add, the ipsets too. The
+// elements of the set of a port are compared with the set its installed rules reference
+func (b iptablesBackend) Plan(f Firewall) (plan FirewallPlan, err error) {
+	ipt, err := b.iptables(f.IPv6)
+	if err != nil {
+		return plan, err
+	}
+	installed := make([]string, 0)
+	// the set referenced by each installed rule, by planKey
+	installedSets := make(map[string]string)
+	exists, err := ipt.ChainExists(table, f.Chain)
+	if err != nil {
+		return plan, err
+	}
+	if exists {
+		rules, err := ipt.List(table, f.Chain)
+		if err != nil {
+			return plan, err
+		}
+		for _, rule := range rules {
+			if spec, ok := strings.CutPrefix(rule, "-A "+f.Chain+" "); ok {
+				installed = append(installed, spec)
+				if set := ruleSet(spec); set != "" {
+					installedSets[b.planKey(spec)] = set
+				}
+			}
+		}
+	}
+	desired := make([]string, 0)
+	// the desired sets and the installed ones they replace
+	used := make([]string, 0)
+	if len(f.Addresses) > 0 {
+		for i, port := range f.Ports {
+			set := b.portSet(f, port)
+			previous := set
+			for _, rule := range b.portRules(f, port, i, set) {
+				spec := joinRule(rule)
+				// appended once
+				if !slices.Contains(desired, spec) {
+					desired = append(desired, spec)
+				}
+				if installedSet, ok := installedSets[b.planKey(spec)]; ok && set != "" {
+					previous = installedSet
+				}
+			}
+			if set == "" {
+				continue
+			}
+			used = append(used, set, previous)
+			entries, err := ipsetEntries(port.remotes(f.IPv6))
+			if err != nil {
+				return plan, err
+			}
+			members, err := ipsetMembers(previous)
+			if err != nil {
+				return plan, err
+			}
+			diffSet(&plan, set, members, entries)
+		}
+	}
+	diffRules(&plan, installed, desired, b.planKey)
+	sets, err := ipsetSets(f)
+	if err != nil && len(used) > 0 {
+		return plan, err
+	}
+	for _, set := range sets {
+		if slices.Contains(used, set) {
+			continue
+		}
+		members, err := ipsetMembers(set)
+		if err != nil {
+			return plan, err
+		}
+		diffSet(&plan, set, members, nil)
+	}
+	return plan, nil
+}
+
+// hostRules returns the rules of the host chain, in the order described by HostFirewall
+func (b iptablesBackend) hostRules(h HostFirewall, v6 bool) (rules [][]string) {
+	for _, iface := range hostInterfaces {
+		rules = append(rules, []string{"-i", iface, "-j", Accept})
+	}
+	rules = append(rules, []string{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", Accept})
+	icmp := "icmp"
+	if v6 {
+		// neighbor discovery goes through ICMPv6, the host is unreachable without it
+		icmp = "ipv6-icmp"
+	}
+	rules = append(rules, []string{"-p", icmp, "-j", Accept})
+	for _, admin := range familyRemotes(h.Admins, v6) {
+		rules = append(rules, []string{"-s", admin, "-j", Accept})
+	}
+	for _, port := range h.Ports {
+		unmatchPolicy := Drop
+		if port.Policy == Drop {
+			unmatchPolicy = Accept
+		}
+		for _, protocol := range port.protocols() {
+			for _, remote := range port.remotes(v6) {
+				rules = append(rules, []string{"-p", protocol, "-s", remote, "--dport", port.portMatch(), "-j", unmatchPolicy})
+			}
+			rules = append(rules, []string{"-p", protocol, "--dport", port.portMatch(), "-j", port.Policy})
+		}
+	}
+	return append(rules, []string{"-j", h.Policy})
+}
+
+// InstallHost swaps the host chain through a shadow chain, like the container chains
+func (b iptablesBackend) InstallHost(h HostFirewall, v6 bool) (err error) {
+	ipt, err := b.iptables(v6)
+	if err != nil {
+		return err
+	}
+	log.Info("installing host chain")
+	return b.swapChain(ipt, input, hostChain, func(shadow string) error {
+		for _, rule := range b.hostRules(h, v6) {
+			err := ipt.Append(table, shadow, rule...)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b iptablesBackend) UninstallHost(v6 bool) (err error) {
+	ipt, err := b.iptables(v6)
+	if err != nil {
+		return err
+	}
+	err = b.recoverShadow(ipt, input, hostChain)
+	if err != nil {
+		return err
+	}
+	exists, err := ipt.ChainExists(table, hostChain)
+	if err != nil || !exists {
+		return err
+	}
+	log.Info("uninstalling host chain")
+	err = ipt.DeleteIfExists(table, input, "-j", hostChain)
+	if err != nil {
+		return fmt.Errorf("failed to remove jump rule from %s: %w", input, err)
+	}
+	return ipt.ClearAndDeleteChain(table, hostChain)
+}
+
+func (b iptablesBackend) ensureParentChain(ipt *iptables.IPTables) (err error) {
+	log.Info("ensuring parent chain")
+	exists, err := ipt.ChainExists(table, forward)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		log.Info("parent chain was missing, creating chain")
+		err = ipt.NewChain(table, forward)
+		if err != nil {
+			return fmt.Errorf("failed to create parent chain: %w", err)
+		}
+		log.Info("created parent chain")
+	}
+	// docker rewrites DOCKER-USER when it restarts, the jump may be gone while the chain is still there
+	err = ipt.InsertUnique(table, tlForward, 1, "-j", forward)
+	if err != nil {
+		return err
+	}
+	log.Info("parent chain setup finished")
+	return nil
+}
@@ -0,0 +1,39 @@
+package containers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Limits caps the connections of each remote to a port, the excess is dropped
+type Limits struct {
+	Rate        int `json:"rate"`        // new connections per second, unlimited when 0
+	Burst       int `json:"burst"`       // new connections accepted above the rate at once, the rate when 0
+	Connections int `json:"connections"` // concurrent connections, unlimited when 0
+}
+
+func (l *Limits) validate() error {
+	if l.Rate < 0 || l.Burst < 0 || l.Connections < 0 {
+		return errors.New("limits can't be negative")
+	}
+	if l.Burst > 0 && l.Rate == 0 {
+		return errors.New("a burst requires a rate")
+	}
+	return nil
+}
+
+func (l *Limits) burst() int {
+	if l.Burst == 0 {
+		return l.Rate
+	}
+	return l.Burst
+}
+
+// hashlimitName names the rate buckets of a port. The kernel keeps the parameters of the first rule using a
+// name, so they're part of it, and names are limited to 15 characters, one is left for the log rule
+func hashlimitName(f Firewall, index int, limits *Limits) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d/%d/%d", f.Chain, index, limits.Rate, limits.burst())))
+	return "sb" + hex.EncodeToString(sum[:])[:12]
+}
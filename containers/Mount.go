@@ -0,0 +1,244 @@
+package containers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// Mount types
+const (
+	MountBind   = "bind"
+	MountVolume = "volume"
+	MountTmpfs  = "tmpfs"
+)
+
+// volumes are labelled with their container, so they can be removed with it
+const containerLabel = "io.serverbench.container"
+
+// bind sources are mounted as subpaths of a volume binding the container directory: docker resolves subpaths
+// within their volume on every mount, restart policy starts included, so a tenant replacing a directory of its
+// tree with a symlink can't get a source outside of it mounted. The name can't be one of a volume spec
+const treeVolume = "_tree"
+
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+
+type MountSpec struct {
+	Type     string `json:"type"`
+	Source   string `json:"source"` // bind: path relative to the container directory, volume: volume name
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"readOnly"`
+	Size     int64  `json:"size"` // tmpfs size in bytes, unlimited when 0
+}
+
+// volumeName namespaces volumes by container, tenants can't reach each other's volumes
+func (c *Container) volumeName(name string) string {
+	return c.cName() + "-" + name
+}
+
+// validateMounts checks the mount specs without touching the filesystem
+func (c *Container) validateMounts() (err error) {
+	targets := map[string]struct{}{
+		path.Clean(c.Mount): {},
+	}
+	for _, m := range c.Mounts {
+		if !path.IsAbs(m.Target) {
+			return fmt.Errorf("invalid mount target %q: must be an absolute path", m.Target)
+		}
+		if _, exists := targets[path.Clean(m.Target)]; exists {
+			return fmt.Errorf("invalid mount target %q: already mounted", m.Target)
+		}
+		targets[path.Clean(m.Target)] = struct{}{}
+		switch m.Type {
+		case MountBind:
+			_, err = c.bindPath(m.Source)
+			if err != nil {
+				return err
+			}
+		case MountVolume:
+			if !volumeNamePattern.MatchString(m.Source) {
+				return fmt.Errorf("invalid volume name %q", m.Source)
+			}
+		case MountTmpfs:
+			if m.Source != "" {
+				return errors.New("tmpfs mounts can't have a source")
+			}
+			if m.Size < 0 {
+				return fmt.Errorf("invalid tmpfs size %d", m.Size)
+			}
+		default:
+			return fmt.Errorf("invalid mount type %q", m.Type)
+		}
+	}
+	return nil
+}
+
+// bindPath returns the path of a bind source relative to the container directory, rejecting
+// anything that would escape it
+func (c *Container) bindPath(source string) (relative string, err error) {
+	relative = filepath.Clean(source)
+	if filepath.IsAbs(relative) || escapes(relative) {
+		return "", fmt.Errorf("invalid bind source %q: must be relative to the container directory", source)
+	}
+	return relative, nil
+}
+
+func escapes(relative string) bool {
+	return relative == ".." || strings.HasPrefix(relative, "../")
+}
+
+// within resolves the symlinks of path and returns it relative to root, failing if it leaves root
+func within(root string, path string) (relative string, err error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	relative, err = filepath.Rel(root, resolved)
+	if err != nil {
+		return "", err
+	}
+	if escapes(relative) {
+		return "", errors.New("escapes the container directory")
+	}
+	return relative, nil
+}
+
+// resolveBind resolves symlinks within the container directory (from the daemon's point of view), so a
+// tenant can't point a bind source outside of its own tree, and creates the source if it's missing
+func (c *Container) resolveBind(source string) (relative string, err error) {
+	relative, err = c.bindPath(source)
+	if err != nil {
+		return "", err
+	}
+	root, err := filepath.EvalSymlinks(c.Dir())
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(root, relative)
+	if _, err := os.Lstat(target); errors.Is(err, os.ErrNotExist) {
+		// the closest existing parent is checked first, so directories are never created through a
+		// symlink leading outside of the tree
+		parent := filepath.Dir(target)
+		for {
+			_, err = os.Lstat(parent)
+			if err == nil || !errors.Is(err, os.ErrNotExist) {
+				break
+			}
+			parent = filepath.Dir(parent)
+		}
+		_, err = within(root, parent)
+		if err != nil {
+			return "", fmt.Errorf("invalid bind source %q: %w", source, err)
+		}
+		log.Info("creating bind source ", relative)
+		err = os.MkdirAll(target, 0755)
+		if err != nil {
+			return "", err
+		}
+		err, perm := c.PermSnippet()
+		if err != nil {
+			return "", err
+		}
+		err = exec.Command("chown", "-R", perm, target).Run()
+		if err != nil {
+			return "", err
+		}
+	}
+	relative, err = within(root, target)
+	if err != nil {
+		return "", fmt.Errorf("invalid bind source %q: %w", source, err)
+	}
+	return relative, nil
+}
+
+// extraMounts returns the docker mounts for the mount specs, hostPath is the container directory on the host
+func (c *Container) extraMounts(hostPath string) (mounts []mount.Mount, err error) {
+	for _, m := range c.Mounts {
+		switch m.Type {
+		case MountBind:
+			relative, err := c.resolveBind(m.Source)
+			if err != nil {
+				return nil, err
+			}
+			if relative == "." {
+				relative = ""
+			}
+			mounts = append(mounts, mount.Mount{
+				Type:     mount.TypeVolume,
+				Source:   c.volumeName(treeVolume),
+				Target:   m.Target,
+				ReadOnly: m.ReadOnly,
+				VolumeOptions: &mount.VolumeOptions{
+					NoCopy:  true,
+					Subpath: relative,
+					Labels: map[string]string{
+						containerLabel: c.Id,
+					},
+					DriverConfig: &mount.Driver{
+						Name: "local",
+						Options: map[string]string{
+							"type":   "none",
+							"o":      "bind",
+							"device": hostPath,
+						},
+					},
+				},
+			})
+		case MountVolume:
+			mounts = append(mounts, mount.Mount{
+				Type:     mount.TypeVolume,
+				Source:   c.volumeName(m.Source),
+				Target:   m.Target,
+				ReadOnly: m.ReadOnly,
+				VolumeOptions: &mount.VolumeOptions{
+					Labels: map[string]string{
+						containerLabel: c.Id,
+					},
+				},
+			})
+		case MountTmpfs:
+			mounts = append(mounts, mount.Mount{
+				Type:     mount.TypeTmpfs,
+				Target:   m.Target,
+				ReadOnly: m.ReadOnly,
+				TmpfsOptions: &mount.TmpfsOptions{
+					SizeBytes: m.Size,
+				},
+			})
+		}
+	}
+	return mounts, nil
+}
+
+// deleteVolumes removes the named volumes of the container, the container must be deleted beforehand
+func (c *Container) deleteVolumes(cli *client.Client) (err error) {
+	log.Info("deleting volumes")
+	volumes, err := cli.VolumeList(context.Background(), volume.ListOptions{
+		Filters: filters.NewArgs(filters.KeyValuePair{
+			Key:   "label",
+			Value: containerLabel + "=" + c.Id,
+		}),
+	})
+	if err != nil {
+		return err
+	}
+	for _, v := range volumes.Volumes {
+		err = cli.VolumeRemove(context.Background(), v.Name, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
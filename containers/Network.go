@@ -0,0 +1,141 @@
+package containers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// own networks are named after the container, group networks after the group and stack networks after the
+// stack, with distinct prefixes so a group can't be named like a container or a stack id and join its network
+const (
+	networkPrefix      = "sb-net-"
+	groupNetworkPrefix = "sb-grp-"
+	stackNetworkPrefix = "sb-stk-"
+)
+
+var networkGroupPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$`)
+
+// networks created by the daemon, the only ones it garbage collects
+const networkLabel = "io.serverbench.network"
+
+// serializes network creation and removal, so a network isn't collected while a container joins it
+var networkLock sync.Mutex
+
+// networkName returns the user-defined bridge of the container: the network of its stack, the group network
+// when provided (the group is chosen by the control plane, e.g. the project), or a network of its own
+func (c *Container) networkName() string {
+	if c.Stack != nil {
+		return stackNetworkPrefix + *c.Stack
+	}
+	if c.Network != nil && *c.Network != "" {
+		return groupNetworkPrefix + *c.Network
+	}
+	return networkPrefix + c.Id
+}
+
+func (c *Container) validateNetwork() (err error) {
+	if c.Network != nil && *c.Network != "" && !networkGroupPattern.MatchString(*c.Network) {
+		return fmt.Errorf("invalid network %q", *c.Network)
+	}
+	for _, alias := range c.Aliases {
+		if len(alias) > 63 || !hostnamePattern.MatchString(alias) {
+			return fmt.Errorf("invalid network alias %q", alias)
+		}
+	}
+	return nil
+}
+
+// publishesIPv6 reports whether the container publishes ports on an IPv6 address
+func (c *Container) publishesIPv6() bool {
+	if len(c.Ports) == 0 {
+		return false
+	}
+	for _, address := range c.addresses() {
+		if isIPv6(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureNetwork creates the network of the container if it doesn't exist yet, networkLock must be held
+// until the container is created. IPv6 ports are only published through the firewall when the network has
+// IPv6, docker-proxy forwards them from INPUT otherwise, so a network without it is refused for them
+func (c *Container) ensureNetwork(cli *client.Client) (err error) {
+	name := c.networkName()
+	ipv6 := c.publishesIPv6()
+	inspect, err := cli.NetworkInspect(context.Background(), name, network.InspectOptions{})
+	if err == nil {
+		if ipv6 && !inspect.EnableIPv6 {
+			return fmt.Errorf("network %s has no IPv6, the ports can't be published on IPv6 addresses until it's recreated", name)
+		}
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return err
+	}
+	log.Info("creating network ", name, ", IPv6: ", ipv6)
+	_, err = cli.NetworkCreate(context.Background(), name, network.CreateOptions{
+		Driver:     "bridge",
+		EnableIPv6: &ipv6,
+		Labels: map[string]string{
+			networkLabel: "true",
+		},
+	})
+	return err
+}
+
+func (c *Container) networkingConfig() *network.NetworkingConfig {
+	return &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			c.networkName(): {
+				Aliases: c.Aliases,
+			},
+		},
+	}
+}
+
+// CollectNetworks removes the networks created by the daemon that no container is attached to anymore
+func CollectNetworks(cli *client.Client) (err error) {
+	networkLock.Lock()
+	defer networkLock.Unlock()
+	networks, err := cli.NetworkList(context.Background(), network.ListOptions{
+		Filters: filters.NewArgs(filters.KeyValuePair{
+			Key:   "label",
+			Value: networkLabel,
+		}),
+	})
+	if err != nil {
+		return err
+	}
+	for _, summary := range networks {
+		// inspecting the network only lists running containers, stopped ones still need it
+		attached, err := cli.ContainerList(context.Background(), container.ListOptions{
+			All: true,
+			Filters: filters.NewArgs(filters.KeyValuePair{
+				Key:   "network",
+				Value: summary.ID,
+			}),
+		})
+		if err != nil {
+			return err
+		}
+		if len(attached) > 0 {
+			continue
+		}
+		log.Info("removing unused network ", summary.Name)
+		err = cli.NetworkRemove(context.Background(), summary.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
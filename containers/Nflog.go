@@ -0,0 +1,205 @@
+package containers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/florianl/go-nflog/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// only the headers of the dropped packets are copied
+const nflogSnaplen = 64
+
+// dropped packets logged per second by a log rule, the next ones are only counted
+const nflogRate = 20
+
+// dropped packets logged at once above the rate, the iptables limit default
+const nflogBurst = 5
+
+// dropped connections kept per container
+const dropLogSize = 256
+
+// DropLog is a packet dropped by the firewall of a container
+type DropLog struct {
+	Timestamp int64  `json:"timestamp"` // unix milliseconds
+	Source    string `json:"source"`
+	Port      int    `json:"port"` // first host port of the port
+	Protocol  string `json:"protocol"`
+	Rule      string `json:"rule"`
+}
+
+// dropRing keeps the last dropped packets of a container
+type dropRing struct {
+	entries []DropLog
+	next    int
+}
+
+func (r *dropRing) add(entry DropLog) {
+	if len(r.entries) < dropLogSize {
+		r.entries = append(r.entries, entry)
+		return
+	}
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % dropLogSize
+}
+
+// ordered returns the entries from the oldest
+func (r *dropRing) ordered() []DropLog {
+	return append(append([]DropLog{}, r.entries[r.next:]...), r.entries[:r.next]...)
+}
+
+var (
+	drops     = make(map[string]*dropRing)
+	dropsLock sync.Mutex
+)
+
+// nflogGroup returns the NFLOG group from FIREWALL_NFLOG_GROUP, drops aren't logged when it isn't set
+func nflogGroup() (group uint16, enabled bool) {
+	value := os.Getenv("FIREWALL_NFLOG_GROUP")
+	if value == "" {
+		return 0, false
+	}
+	parsed, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		log.Error("invalid FIREWALL_NFLOG_GROUP ", value)
+		return 0, false
+	}
+	return uint16(parsed), true
+}
+
+// nflogPrefix attributes the logged packets to the chain and the rule
+func nflogPrefix(f Firewall, comment string) string {
+	return f.Chain + " " + comment
+}
+
+// packetSource returns the source address in the ip header of the packet
+func packetSource(payload []byte) (source net.IP, ok bool) {
+	if len(payload) < 20 {
+		return nil, false
+	}
+	switch payload[0] >> 4 {
+	case 4:
+		return net.IP(payload[12:16]), true
+	case 6:
+		if len(payload) < 40 {
+			return nil, false
+		}
+		return net.IP(payload[8:24]), true
+	}
+	return nil, false
+}
+
+// logDrop records a packet logged by a drop rule
+func logDrop(attribute nflog.Attribute) {
+	if attribute.Prefix == nil || attribute.Payload == nil {
+		return
+	}
+	chain, comment, found := strings.Cut(*attribute.Prefix, " ")
+	id, managed := strings.CutPrefix(chain, "sb-")
+	if !found || !managed {
+		return
+	}
+	counter, ok := parseRuleComment(comment)
+	if !ok {
+		return
+	}
+	source, ok := packetSource(*attribute.Payload)
+	if !ok {
+		return
+	}
+	timestamp := time.Now()
+	if attribute.Timestamp != nil {
+		timestamp = *attribute.Timestamp
+	}
+	dropsLock.Lock()
+	defer dropsLock.Unlock()
+	ring, ok := drops[id]
+	if !ok {
+		ring = &dropRing{}
+		drops[id] = ring
+	}
+	ring.add(DropLog{
+		Timestamp: timestamp.UnixMilli(),
+		Source:    source.String(),
+		Port:      counter.Port,
+		Protocol:  counter.Protocol,
+		Rule:      counter.Rule,
+	})
+}
+
+// StartDropLog receives the packets logged by the drop rules in the host network namespace until the context
+// is done, nothing is logged unless FIREWALL_NFLOG_GROUP is set
+func StartDropLog(ctx context.Context) (err error) {
+	group, enabled := nflogGroup()
+	if !enabled {
+		return nil
+	}
+	config := &nflog.Config{
+		Group:    group,
+		Copymode: nflog.CopyPacket,
+		Bufsize:  nflogSnaplen,
+	}
+	ns, err := os.Open(hostNetNS)
+	if err == nil {
+		defer ns.Close()
+		config.NetNS = int(ns.Fd())
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	nf, err := nflog.Open(config)
+	if err != nil {
+		return err
+	}
+	err = nf.RegisterWithErrorFunc(ctx, func(attribute nflog.Attribute) int {
+		logDrop(attribute)
+		return 0
+	}, func(err error) int {
+		if ctx.Err() != nil {
+			return 1
+		}
+		// the kernel drops the logs the socket can't buffer, the next ones are still received
+		log.Debug("nflog receive failed: ", err)
+		return 0
+	})
+	if err != nil {
+		nf.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		nf.Close()
+	}()
+	log.Info("logging dropped packets of nflog group ", group)
+	return nil
+}
+
+// Drops returns the logged packets dropped by the firewall of the container since the timestamp (unix
+// milliseconds), from the oldest
+func (c *Container) Drops(since int64) []DropLog {
+	dropsLock.Lock()
+	defer dropsLock.Unlock()
+	ring, ok := drops[c.Id]
+	if !ok {
+		return []DropLog{}
+	}
+	entries := make([]DropLog, 0)
+	for _, entry := range ring.ordered() {
+		if entry.Timestamp >= since {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (c *Container) forgetDrops() {
+	dropsLock.Lock()
+	defer dropsLock.Unlock()
+	delete(drops, c.Id)
+}
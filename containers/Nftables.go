@@ -0,0 +1,1211 @@
+package containers
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	nftTable      = "serverbench"
+	nftPrerouting = "prerouting"
+	nftInput      = "input"
+	// the docker chains in the iptables-nft filter table, when docker runs on nftables
+	nftDockerTable = "filter"
+	nftDockerChain = "DOCKER-USER"
+)
+
+// the sets of a port, named <chain>-<kind>-<port index>
+const (
+	nftRemotesSet     = "remotes"
+	nftRateSet        = "rate"
+	nftConnectionsSet = "connections"
+	// the meters of the log rules of the limits
+	nftRateLogSet        = "ratelog"
+	nftConnectionsLogSet = "connectionslog"
+)
+
+// the sets of a chain, named <chain>-addresses or <chain>-<kind>-<port index>
+var nftSetPattern = regexp.MustCompile(`^(.+)-(addresses|(` + nftRemotesSet + `|` + nftRateSet + `|` + nftConnectionsSet + `|` + nftRateLogSet + `|` + nftConnectionsLogSet + `)-\d+)$`)
+
+// the rules match the packets of the original direction right before docker's DNAT, while their addresses
+// and ports are still the original tuple the iptables backend finds in conntrack. Replies are left alone, e.g.
+// the reply to a masqueraded connection of a container may be sent to a published port
+var nftPriority = nftables.ChainPriorityRef(*nftables.ChainPriorityNATDest - 1)
+
+// the direction of the packets of the remote, IP_CT_DIR_ORIGINAL
+const ctDirOriginal = 0
+
+var nftProtocols = map[string]byte{
+	tcp: unix.IPPROTO_TCP,
+	udp: unix.IPPROTO_UDP,
+}
+
+// nftablesBackend manages a serverbench table per address family over netlink, with a chain and an
+// address set per container. Every install is applied as a single transaction
+type nftablesBackend struct{}
+
+func (b nftablesBackend) Name() string {
+	return BackendNftables
+}
+
+// conn opens a netlink connection in the host network namespace, the current one when it isn't mounted
+func (b nftablesBackend) conn() (conn *nftables.Conn, done func(), err error) {
+	ns, err := os.Open(hostNetNS)
+	if errors.Is(err, os.ErrNotExist) {
+		conn, err = nftables.New()
+		return conn, func() {}, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err = nftables.New(nftables.WithNetNSFd(int(ns.Fd())))
+	if err != nil {
+		ns.Close()
+		return nil, nil, err
+	}
+	return conn, func() { ns.Close() }, nil
+}
+
+// nftablesNative reports whether the host rules live in nftables, i.e. docker runs on iptables-nft
+func nftablesNative() bool {
+	conn, done, err := nftablesBackend{}.conn()
+	if err != nil {
+		return false
+	}
+	defer done()
+	dockerTable, err := conn.ListTableOfFamily(nftDockerTable, nftables.TableFamilyIPv4)
+	if err != nil {
+		return false
+	}
+	_, err = conn.ListChain(dockerTable, nftDockerChain)
+	return err == nil
+}
+
+func nftFamily(v6 bool) nftables.TableFamily {
+	if v6 {
+		return nftables.TableFamilyIPv6
+	}
+	return nftables.TableFamilyIPv4
+}
+
+func (b nftablesBackend) table(f Firewall) *nftables.Table {
+	return &nftables.Table{
+		Name:   nftTable,
+		Family: nftFamily(f.IPv6),
+	}
+}
+
+func (b nftablesBackend) parentChain(table *nftables.Table) *nftables.Chain {
+	policy := nftables.ChainPolicyAccept
+	return &nftables.Chain{
+		Name:     nftPrerouting,
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftPriority,
+		Policy:   &policy,
+	}
+}
+
+func (b nftablesBackend) addressSet(table *nftables.Table, f Firewall) *nftables.Set {
+	keyType := nftables.TypeIPAddr
+	if f.IPv6 {
+		keyType = nftables.TypeIP6Addr
+	}
+	return &nftables.Set{
+		Table:   table,
+		Name:    f.Chain + "-addresses",
+		KeyType: keyType,
+	}
+}
+
+// ipBytes returns the address in the length of its family
+func ipBytes(ip net.IP, v6 bool) []byte {
+	if v6 {
+		return ip.To16()
+	}
+	return ip.To4()
+}
+
+// jumps returns the rules of the parent chain jumping to the chain
+func (b nftablesBackend) jumps(conn *nftables.Conn, table *nftables.Table, chain string) (jumps []*nftables.Rule, err error) {
+	rules, err := conn.GetRules(table, b.parentChain(table))
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		for _, e := range rule.Exprs {
+			if verdict, ok := e.(*expr.Verdict); ok && verdict.Kind == expr.VerdictJump && verdict.Chain == chain {
+				jumps = append(jumps, rule)
+			}
+		}
+	}
+	return jumps, nil
+}
+
+func (b nftablesBackend) Install(f Firewall) (err error) {
+	conn, done, err := b.conn()
+	if err != nil {
+		return err
+	}
+	defer done()
+	log.Info("installing chain")
+	// the table and chains are created first, so the existing jump can be looked up
+	table := conn.AddTable(b.table(f))
+	parent := conn.AddChain(b.parentChain(table))
+	chain := conn.AddChain(&nftables.Chain{
+		Name:  f.Chain,
+		Table: table,
+	})
+	set := b.addressSet(table, f)
+	err = conn.AddSet(set, nil)
+	if err != nil {
+		return err
+	}
+	err = conn.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to create chain: %w", err)
+	}
+	jumps, err := b.jumps(conn, table, f.Chain)
+	if err != nil {
+		return err
+	}
+	sets, err := conn.GetSets(table)
+	if err != nil {
+		return err
+	}
+	// the rules, addresses and remotes are replaced in a single transaction, the chain is never seen
+	// half-filled
+	conn.FlushChain(chain)
+	conn.FlushSet(set)
+	elements := make([]nftables.SetElement, 0, len(f.Addresses))
+	for _, address := range f.Addresses {
+		elements = append(elements, nftables.SetElement{Key: ipBytes(net.ParseIP(address), f.IPv6)})
+	}
+	err = conn.SetAddElements(set, elements)
+	if err != nil {
+		return err
+	}
+	used := make(map[string]struct{})
+	for i, port := range f.Ports {
+		portSets, err := b.securePort(conn, chain, set, f, port, i)
+		if err != nil {
+			return err
+		}
+		for _, portSet := range portSets {
+			used[portSet.Name] = struct{}{}
+		}
+	}
+	// sets of removed ports are deleted along, the chain flush released them
+	for _, existing := range sets {
+		if _, ok := used[existing.Name]; !ok && b.isPortSet(f, existing.Name) {
+			conn.DelSet(existing)
+		}
+	}
+	if len(jumps) == 0 {
+		conn.AddRule(&nftables.Rule{
+			Table: table,
+			Chain: parent,
+			Exprs: []expr.Any{
+				&expr.Verdict{Kind: expr.VerdictJump, Chain: f.Chain},
+			},
+		})
+	}
+	err = conn.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to install chain: %w", err)
+	}
+	return nil
+}
+
+// verdict converts a policy into its nftables verdict
+func verdict(policy string) *expr.Verdict {
+	if policy == Drop {
+		return &expr.Verdict{Kind: expr.VerdictDrop}
+	}
+	return &expr.Verdict{Kind: expr.VerdictAccept}
+}
+
+// addressPayload loads the source or destination address of the packet
+func addressPayload(v6 bool, source bool) *expr.Payload {
+	payload := &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4}
+	if v6 {
+		payload.Offset, payload.Len = 24, 16
+	}
+	if source {
+		payload.Offset -= payload.Len
+	}
+	return payload
+}
+
+// portMatch matches the packets sent by the remotes, the protocol, the destination (one of the container
+// addresses) and the destination port (the host port). The conntrack original tuple isn't loaded, the
+// netlink library can't read back the direction of ct expressions
+func (b nftablesBackend) portMatch(set *nftables.Set, f Firewall, port Port, protocol string) []expr.Any {
+	exprs := []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeyDIRECTION},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{ctDirOriginal}},
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nftProtocols[protocol]}},
+		addressPayload(f.IPv6, false),
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+	}
+	return append(exprs, destinationPort(port)...)
+}
+
+// destinationPort matches the destination port with the port (or range)
+func destinationPort(port Port) []expr.Any {
+	exprs := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+	}
+	if port.last() == port.Port {
+		return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(port.Port))})
+	}
+	return append(exprs, &expr.Range{
+		Op:       expr.CmpOpEq,
+		Register: 1,
+		FromData: binaryutil.BigEndian.PutUint16(uint16(port.Port)),
+		ToData:   binaryutil.BigEndian.PutUint16(uint16(port.last())),
+	})
+}
+
+// remoteSet is the interval set holding the remotes of a port
+func (b nftablesBackend) remoteSet(chain *nftables.Chain, f Firewall, index int) *nftables.Set {
+	set := b.addressSet(chain.Table, f)
+	set.Name = f.Chain + "-" + nftRemotesSet + "-" + strconv.Itoa(index)
+	set.Interval = true
+	return set
+}
+
+// limitSet is the meter of a port, holding the rate buckets or the connection counts of each remote
+func (b nftablesBackend) limitSet(chain *nftables.Chain, f Firewall, kind string, index int) *nftables.Set {
+	set := b.addressSet(chain.Table, f)
+	set.Name = f.Chain + "-" + kind + "-" + strconv.Itoa(index)
+	set.Dynamic = true
+	if kind == nftRateSet || kind == nftRateLogSet {
+		// idle remotes are forgotten, their bucket is full again anyway
+		set.HasTimeout = true
+		set.Timeout = time.Minute
+	}
+	return set
+}
+
+// isPortSet reports whether the set belongs to a port of the chain (and not of another chain sharing the
+// prefix, e.g. sb-web and sb-web-db)
+func (b nftablesBackend) isPortSet(f Firewall, name string) bool {
+	for _, kind := range []string{nftRemotesSet, nftRateSet, nftConnectionsSet, nftRateLogSet, nftConnectionsLogSet} {
+		index, found := strings.CutPrefix(name, f.Chain+"-"+kind+"-")
+		if _, err := strconv.Atoi(index); found && err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteElements converts the remotes into the elements of an interval set
+func remoteElements(remotes []string) (elements []nftables.SetElement, err error) {
+	ranges, err := remoteRanges(remotes)
+	if err != nil {
+		return nil, err
+	}
+	elements = make([]nftables.SetElement, 0, len(ranges)*2)
+	for _, r := range ranges {
+		elements = append(elements, nftables.SetElement{Key: r.First.AsSlice()})
+		// interval ends are exclusive, a range reaching the last address has no end
+		if end := r.Last.Next(); end.IsValid() {
+			elements = append(elements, nftables.SetElement{Key: end.AsSlice(), IntervalEnd: true})
+		}
+	}
+	return elements, nil
+}
+
+// newConnection matches the first packet of a connection
+func newConnection() []expr.Any {
+	return ctState(expr.CtStateBitNEW)
+}
+
+// ctState matches the packets whose conntrack state is one of the states
+func ctState(states uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(states),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
+
+// countedRule completes the match with a counter and the verdict, commented like the iptables rules. Drops
+// are logged first when enabled, by a rule without comment so it isn't counted twice. The log rule matches
+// logMatch, the limits meter the remotes in their own sets there, with the same parameters they take the
+// same decisions
+func (b nftablesBackend) countedRule(chain *nftables.Chain, f Firewall, match []expr.Any, logMatch []expr.Any, comment string, policy string) (rules []*nftables.Rule) {
+	if group, enabled := nflogGroup(); enabled && policy == Drop {
+		// a limit stops the rule once exceeded, the log rule never drops
+		rules = append(rules, &nftables.Rule{
+			Table: chain.Table,
+			Chain: chain,
+			Exprs: append(slices.Clone(logMatch),
+				&expr.Limit{Type: expr.LimitTypePkts, Rate: nflogRate, Unit: expr.LimitTimeSecond, Burst: nflogBurst},
+				&expr.Log{
+					Key:     1<<unix.NFTA_LOG_GROUP | 1<<unix.NFTA_LOG_PREFIX | 1<<unix.NFTA_LOG_SNAPLEN,
+					Group:   group,
+					Snaplen: nflogSnaplen,
+					Data:    []byte(nflogPrefix(f, comment)),
+				},
+			),
+		})
+	}
+	return append(rules, &nftables.Rule{
+		Table:    chain.Table,
+		Chain:    chain,
+		Exprs:    append(slices.Clone(match), &expr.Counter{}, verdict(policy)),
+		UserData: userdata.AppendString(nil, userdata.TypeComment, comment),
+	})
+}
+
+// limitRule drops the new connections of the remotes the meter finds above the limit, logMeter is the meter
+// of the log rule, nil when drops aren't logged
+func (b nftablesBackend) limitRule(chain *nftables.Chain, set *nftables.Set, meter *nftables.Set, logMeter *nftables.Set, f Firewall, port Port, protocol string, rule string, operation uint32, limit expr.Any) []*nftables.Rule {
+	match := func(meter *nftables.Set) []expr.Any {
+		if meter == nil {
+			return nil
+		}
+		exprs := append(b.portMatch(set, f, port, protocol), newConnection()...)
+		return append(exprs,
+			addressPayload(f.IPv6, true),
+			&expr.Dynset{SrcRegKey: 1, SetName: meter.Name, SetID: meter.ID, Operation: operation, Exprs: []expr.Any{limit}},
+		)
+	}
+	return b.countedRule(chain, f, match(meter), match(logMeter), ruleComment(rule, port, protocol), Drop)
+}
+
+// portSets are the sets used by the rules of a port, nil when unused
+type portSets struct {
+	remotes        *nftables.Set
+	elements       []nftables.SetElement // the remotes
+	rate           *nftables.Set
+	connections    *nftables.Set
+	rateLog        *nftables.Set
+	connectionsLog *nftables.Set
+}
+
+func (s portSets) all() (sets []*nftables.Set) {
+	for _, set := range []*nftables.Set{s.remotes, s.rate, s.connections, s.rateLog, s.connectionsLog} {
+		if set != nil {
+			sets = append(sets, set)
+		}
+	}
+	return sets
+}
+
+// portSets returns the sets the rules of the port need
+func (b nftablesBackend) portSets(chain *nftables.Chain, f Firewall, port Port, index int) (sets portSets, err error) {
+	remotes := port.remotes(f.IPv6)
+	if len(remotes) > 0 {
+		sets.elements, err = remoteElements(remotes)
+		if err != nil {
+			return sets, err
+		}
+		sets.remotes = b.remoteSet(chain, f, index)
+	}
+	_, logged := nflogGroup()
+	if port.Limits != nil && port.Limits.Rate > 0 {
+		sets.rate = b.limitSet(chain, f, nftRateSet, index)
+		if logged {
+			sets.rateLog = b.limitSet(chain, f, nftRateLogSet, index)
+		}
+	}
+	if port.Limits != nil && port.Limits.Connections > 0 {
+		sets.connections = b.limitSet(chain, f, nftConnectionsSet, index)
+		if logged {
+			sets.connectionsLog = b.limitSet(chain, f, nftConnectionsLogSet, index)
+		}
+	}
+	return sets, nil
+}
+
+// addPortSets adds the sets of the port to the transaction. The remotes are replaced and the rate buckets
+// reset, their rate may have changed. The connection counts are kept, flushing them would let the remotes
+// open the limit again
+func (b nftablesBackend) addPortSets(conn *nftables.Conn, sets portSets) (err error) {
+	for _, set := range sets.all() {
+		err = conn.AddSet(set, nil)
+		if err != nil {
+			return err
+		}
+	}
+	if sets.remotes != nil {
+		conn.FlushSet(sets.remotes)
+		err = conn.SetAddElements(sets.remotes, sets.elements)
+		if err != nil {
+			return err
+		}
+	}
+	for _, set := range []*nftables.Set{sets.rate, sets.rateLog} {
+		if set != nil {
+			conn.FlushSet(set)
+		}
+	}
+	return nil
+}
+
+// portRules returns the rules of a port, same layout as the iptables backend: the limits, the remotes (with
+// the opposite policy), then the port policy. The remotes are in a set, a single rule per protocol matches
+// them whatever their number
+func (b nftablesBackend) portRules(chain *nftables.Chain, set *nftables.Set, f Firewall, port Port, sets portSets) (rules []*nftables.Rule) {
+	unmatchPolicy := Drop
+	if port.Policy == Drop {
+		unmatchPolicy = Accept
+	}
+	for _, protocol := range port.protocols() {
+		if sets.rate != nil {
+			rules = append(rules, b.limitRule(chain, set, sets.rate, sets.rateLog, f, port, protocol, RuleRateLimit, unix.NFT_DYNSET_OP_UPDATE, &expr.Limit{
+				Type:  expr.LimitTypePkts,
+				Rate:  uint64(port.Limits.Rate),
+				Over:  true,
+				Unit:  expr.LimitTimeSecond,
+				Burst: uint32(port.Limits.burst()),
+			})...)
+		}
+		if sets.connections != nil {
+			rules = append(rules, b.limitRule(chain, set, sets.connections, sets.connectionsLog, f, port, protocol, RuleConnectionLimit, unix.NFT_DYNSET_OP_ADD, &expr.Connlimit{
+				Count: uint32(port.Limits.Connections),
+				Flags: expr.NFT_CONNLIMIT_F_INV,
+			})...)
+		}
+	}
+	if sets.remotes != nil {
+		for _, protocol := range port.protocols() {
+			exprs := append(b.portMatch(set, f, port, protocol),
+				addressPayload(f.IPv6, true),
+				&expr.Lookup{SourceRegister: 1, SetName: sets.remotes.Name, SetID: sets.remotes.ID},
+			)
+			rules = append(rules, b.countedRule(chain, f, exprs, exprs, ruleComment(RuleRemote, port, protocol), unmatchPolicy)...)
+		}
+	}
+	for _, protocol := range port.protocols() {
+		match := b.portMatch(set, f, port, protocol)
+		rules = append(rules, b.countedRule(chain, f, match, match, ruleComment(RulePolicy, port, protocol), port.Policy)...)
+	}
+	return rules
+}
+
+// securePort adds the sets and the rules of a port, the sets are returned
+func (b nftablesBackend) securePort(conn *nftables.Conn, chain *nftables.Chain, set *nftables.Set, f Firewall, port Port, index int) (sets []*nftables.Set, err error) {
+	log.Info("securing port")
+	used, err := b.portSets(chain, f, port, index)
+	if err != nil {
+		return nil, err
+	}
+	// the sets get their id here, the rules reference it
+	err = b.addPortSets(conn, used)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range b.portRules(chain, set, f, port, used) {
+		conn.AddRule(rule)
+	}
+	log.Info("secured port")
+	return used.all(), nil
+}
+
+// elementKeys returns the keys of the elements, with the interval ends marked
+func elementKeys(elements []nftables.SetElement) []string {
+	keys := make([]string, 0, len(elements))
+	for _, element := range elements {
+		key := hex.EncodeToString(element.Key)
+		if element.IntervalEnd {
+			key += "-end"
+		}
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// checkSet compares the elements of the set with the expected ones
+func (b nftablesBackend) checkSet(conn *nftables.Conn, sets map[string]*nftables.Set, name string, expected []nftables.SetElement) (drift []string, err error) {
+	set, ok := sets[name]
+	if !ok {
+		return []string{"missing set " + name}, nil
+	}
+	elements, err := conn.GetSetElements(set)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Equal(elementKeys(elements), elementKeys(expected)) {
+		drift = append(drift, "unexpected elements in set "+name)
+	}
+	return drift, nil
+}
+
+// Check compares the table with the firewall: the chains and jump, the set elements and the number of rules
+func (b nftablesBackend) Check(f Firewall) (drift []string, err error) {
+	conn, done, err := b.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	table, err := conn.ListTableOfFamily(nftTable, nftFamily(f.IPv6))
+	if err != nil {
+		if len(f.Addresses) == 0 {
+			return nil, nil
+		}
+		return []string{"missing table " + nftTable}, nil
+	}
+	chain, chainErr := conn.ListChain(table, f.Chain)
+	if len(f.Addresses) == 0 {
+		if chainErr == nil {
+			drift = append(drift, "unexpected chain "+f.Chain)
+		}
+		return drift, nil
+	}
+	if chainErr != nil {
+		return []string{"missing chain " + f.Chain}, nil
+	}
+	_, err = conn.ListChain(table, nftPrerouting)
+	if err != nil {
+		drift = append(drift, "missing chain "+nftPrerouting)
+	} else {
+		jumps, err := b.jumps(conn, table, f.Chain)
+		if err != nil {
+			return nil, err
+		}
+		if len(jumps) == 0 {
+			drift = append(drift, "missing jump from "+nftPrerouting+" to "+f.Chain)
+		}
+	}
+	existing, err := conn.GetSets(table)
+	if err != nil {
+		return nil, err
+	}
+	sets := make(map[string]*nftables.Set, len(existing))
+	for _, set := range existing {
+		sets[set.Name] = set
+	}
+	addresses := make([]nftables.SetElement, 0, len(f.Addresses))
+	for _, address := range f.Addresses {
+		addresses = append(addresses, nftables.SetElement{Key: ipBytes(net.ParseIP(address), f.IPv6)})
+	}
+	setDrift, err := b.checkSet(conn, sets, b.addressSet(table, f).Name, addresses)
+	if err != nil {
+		return nil, err
+	}
+	drift = append(drift, setDrift...)
+	expected := 0
+	for i, port := range f.Ports {
+		used, err := b.portSets(chain, f, port, i)
+		if err != nil {
+			return nil, err
+		}
+		expected += len(b.portRules(chain, b.addressSet(table, f), f, port, used))
+		if used.remotes == nil {
+			continue
+		}
+		setDrift, err = b.checkSet(conn, sets, used.remotes.Name, used.elements)
+		if err != nil {
+			return nil, err
+		}
+		drift = append(drift, setDrift...)
+	}
+	rules, err := conn.GetRules(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) != expected {
+		drift = append(drift, fmt.Sprintf("%s has %d rules instead of %d", f.Chain, len(rules), expected))
+	}
+	return drift, nil
+}
+
+// Counters sums the counters of the commented rules of the chain
+func (b nftablesBackend) Counters(f Firewall) (counters []Counter, err error) {
+	conn, done, err := b.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	counters = make([]Counter, 0)
+	table, err := conn.ListTableOfFamily(nftTable, nftFamily(f.IPv6))
+	if err != nil {
+		return counters, nil
+	}
+	chain, err := conn.ListChain(table, f.Chain)
+	if err != nil {
+		return counters, nil
+	}
+	rules, err := conn.GetRules(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		comment, ok := userdata.GetString(rule.UserData, userdata.TypeComment)
+		if !ok {
+			continue
+		}
+		counter, ok := parseRuleComment(comment)
+		if !ok {
+			continue
+		}
+		for _, e := range rule.Exprs {
+			if c, ok := e.(*expr.Counter); ok {
+				counter.Packets, counter.Bytes = c.Packets, c.Bytes
+			}
+		}
+		counters = addCounter(counters, counter)
+	}
+	return counters, nil
+}
+
+// describeRule formats the rule like nft lists it, as far as the expressions used by the backend go. The ids
+// and the counter values are left out, so installed and planned rules compare
+func describeRule(rule *nftables.Rule) string {
+	words := make([]string, 0)
+	// the value loaded in the register, used by the next comparison
+	var loaded string
+	for _, e := range rule.Exprs {
+		switch e := e.(type) {
+		case *expr.Meta:
+			loaded = "meta l4proto"
+		case *expr.Ct:
+			loaded = describeCt(e)
+		case *expr.Bitwise:
+			if loaded == "ct state" && binaryutil.NativeEndian.Uint32(e.Mask) == expr.CtStateBitNEW {
+				loaded = "ct state new"
+			}
+		case *expr.Payload:
+			loaded = describePayload(e)
+		case *expr.Cmp:
+			switch {
+			case loaded == "ct state new":
+				words = append(words, loaded)
+			case loaded == "ct direction" && len(e.Data) == 1 && e.Data[0] == ctDirOriginal:
+				words = append(words, loaded+" original")
+			case loaded == "meta l4proto" && len(e.Data) == 1:
+				protocol := strconv.Itoa(int(e.Data[0]))
+				for name, number := range nftProtocols {
+					if number == e.Data[0] {
+						protocol = name
+					}
+				}
+				words = append(words, loaded+" "+protocol)
+			case len(e.Data) == 2:
+				words = append(words, loaded+" "+strconv.Itoa(int(binaryutil.BigEndian.Uint16(e.Data))))
+			default:
+				words = append(words, loaded+" "+hex.EncodeToString(e.Data))
+			}
+		case *expr.Range:
+			words = append(words, fmt.Sprintf("%s %d-%d", loaded, binaryutil.BigEndian.Uint16(e.FromData), binaryutil.BigEndian.Uint16(e.ToData)))
+		case *expr.Lookup:
+			words = append(words, loaded+" @"+e.SetName)
+		case *expr.Dynset:
+			operation := "add"
+			if e.Operation == unix.NFT_DYNSET_OP_UPDATE {
+				operation = "update"
+			}
+			statement := loaded
+			for _, inner := range e.Exprs {
+				switch inner := inner.(type) {
+				case *expr.Limit:
+					statement += fmt.Sprintf(" limit rate over %d/second burst %d packets", inner.Rate, inner.Burst)
+				case *expr.Connlimit:
+					statement += fmt.Sprintf(" ct count over %d", inner.Count)
+				}
+			}
+			words = append(words, fmt.Sprintf("%s @%s { %s }", operation, e.SetName, statement))
+		case *expr.Limit:
+			words = append(words, fmt.Sprintf("limit rate %d/second burst %d packets", e.Rate, e.Burst))
+		case *expr.Counter:
+			words = append(words, "counter")
+		case *expr.Log:
+			words = append(words, fmt.Sprintf("log prefix %q group %d snaplen %d", string(e.Data), e.Group, e.Snaplen))
+		case *expr.Verdict:
+			switch e.Kind {
+			case expr.VerdictAccept:
+				words = append(words, "accept")
+			case expr.VerdictDrop:
+				words = append(words, "drop")
+			case expr.VerdictJump:
+				words = append(words, "jump "+e.Chain)
+			default:
+				words = append(words, fmt.Sprintf("verdict %d", e.Kind))
+			}
+		default:
+			words = append(words, fmt.Sprintf("%T", e))
+		}
+	}
+	if comment, ok := userdata.GetString(rule.UserData, userdata.TypeComment); ok {
+		words = append(words, fmt.Sprintf("comment %q", comment))
+	}
+	return strings.Join(words, " ")
+}
+
+// describeCt names the conntrack keys loaded by the backend
+func describeCt(ct *expr.Ct) string {
+	switch ct.Key {
+	case expr.CtKeySTATE:
+		return "ct state"
+	case expr.CtKeyDIRECTION:
+		return "ct direction"
+	}
+	return fmt.Sprintf("ct %d", ct.Key)
+}
+
+// describePayload names the header fields loaded by the backend
+func describePayload(payload *expr.Payload) string {
+	if payload.Base == expr.PayloadBaseTransportHeader && payload.Offset == 2 {
+		return "th dport"
+	}
+	if payload.Base == expr.PayloadBaseNetworkHeader {
+		switch {
+		case payload.Len == 4 && payload.Offset == 12:
+			return "ip saddr"
+		case payload.Len == 4 && payload.Offset == 16:
+			return "ip daddr"
+		case payload.Len == 16 && payload.Offset == 8:
+			return "ip6 saddr"
+		case payload.Len == 16 && payload.Offset == 24:
+			return "ip6 daddr"
+		}
+	}
+	return fmt.Sprintf("payload %d %d %d", payload.Base, payload.Offset, payload.Len)
+}
+
+// elementRanges converts the elements of an interval set back into ranges
+func elementRanges(elements []nftables.SetElement) (ranges []string) {
+	slices.SortFunc(elements, func(a, b nftables.SetElement) int {
+		return bytes.Compare(a.Key, b.Key)
+	})
+	for i, element := range elements {
+		if element.IntervalEnd {
+			continue
+		}
+		first, ok := netip.AddrFromSlice(element.Key)
+		if !ok {
+			continue
+		}
+		// a range without end reaches the last address
+		last := lastAddress(netip.PrefixFrom(first, 0))
+		if i+1 < len(elements) && elements[i+1].IntervalEnd {
+			if end, ok := netip.AddrFromSlice(elements[i+1].Key); ok {
+				last = end.Prev()
+			}
+		}
+		ranges = append(ranges, remoteRange{First: first, Last: last}.String())
+	}
+	return ranges
+}
+
+// Plan lists the rules and sets of the chain and compares them with the ones Install would add
+func (b nftablesBackend) Plan(f Firewall) (plan FirewallPlan, err error) {
+	conn, done, err := b.conn()
+	if err != nil {
+		return plan, err
+	}
+	defer done()
+	table := b.table(f)
+	chain := &nftables.Chain{Name: f.Chain, Table: table}
+	installed := make([]string, 0)
+	sets := make(map[string]*nftables.Set)
+	existingTable, err := conn.ListTableOfFamily(nftTable, nftFamily(f.IPv6))
+	if err == nil {
+		existingChain, err := conn.ListChain(existingTable, f.Chain)
+		if err == nil {
+			rules, err := conn.GetRules(existingTable, existingChain)
+			if err != nil {
+				return plan, err
+			}
+			for _, rule := range rules {
+				installed = append(installed, describeRule(rule))
+			}
+		}
+		existingSets, err := conn.GetSets(existingTable)
+		if err != nil {
+			return plan, err
+		}
+		for _, set := range existingSets {
+			if set.Name == b.addressSet(table, f).Name || b.isPortSet(f, set.Name) {
+				sets[set.Name] = set
+			}
+		}
+	}
+	// the elements of a set, the addresses or the remote ranges
+	elements := func(name string) (described []string, err error) {
+		set, ok := sets[name]
+		if !ok {
+			return nil, nil
+		}
+		delete(sets, name)
+		setElements, err := conn.GetSetElements(set)
+		if err != nil {
+			return nil, err
+		}
+		if set.Interval {
+			return elementRanges(setElements), nil
+		}
+		for _, element := range setElements {
+			if address, ok := netip.AddrFromSlice(element.Key); ok {
+				described = append(described, address.String())
+			}
+		}
+		return described, nil
+	}
+	desired := make([]string, 0)
+	if len(f.Addresses) > 0 {
+		addressSet := b.addressSet(table, f)
+		addresses := make([]string, 0, len(f.Addresses))
+		for _, address := range f.Addresses {
+			addresses = append(addresses, netip.MustParseAddr(address).Unmap().String())
+		}
+		existing, err := elements(addressSet.Name)
+		if err != nil {
+			return plan, err
+		}
+		diffSet(&plan, addressSet.Name, existing, addresses)
+		for i, port := range f.Ports {
+			used, err := b.portSets(chain, f, port, i)
+			if err != nil {
+				return plan, err
+			}
+			for _, rule := range b.portRules(chain, addressSet, f, port, used) {
+				desired = append(desired, describeRule(rule))
+			}
+			for _, set := range used.all() {
+				existing, err := elements(set.Name)
+				if err != nil {
+					return plan, err
+				}
+				if set != used.remotes {
+					// the meters are filled by the traffic
+					continue
+				}
+				ranges, err := remoteRanges(port.remotes(f.IPv6))
+				if err != nil {
+					return plan, err
+				}
+				remotes := make([]string, 0, len(ranges))
+				for _, r := range ranges {
+					remotes = append(remotes, r.String())
+				}
+				diffSet(&plan, set.Name, existing, remotes)
+			}
+		}
+	}
+	diffRules(&plan, installed, desired, func(rule string) string {
+		return rule
+	})
+	// the sets Install would delete
+	stale := make([]string, 0, len(sets))
+	for name, set := range sets {
+		if !set.Dynamic {
+			stale = append(stale, name)
+		}
+	}
+	slices.Sort(stale)
+	for _, name := range stale {
+		existing, err := elements(name)
+		if err != nil {
+			return plan, err
+		}
+		diffSet(&plan, name, existing, nil)
+	}
+	return plan, nil
+}
+
+func (b nftablesBackend) Uninstall(f Firewall) (err error) {
+	log.Info("uninstalling chain")
+	conn, done, err := b.conn()
+	if err != nil {
+		return err
+	}
+	defer done()
+	table, err := conn.ListTableOfFamily(nftTable, nftFamily(f.IPv6))
+	if err != nil {
+		// no table, nothing was ever installed in that family
+		return nil
+	}
+	// the sets are deleted even without the chain, they outlive it when an uninstall is interrupted
+	chain, err := conn.ListChain(table, f.Chain)
+	if err == nil {
+		jumps, err := b.jumps(conn, table, f.Chain)
+		if err != nil {
+			return err
+		}
+		for _, jump := range jumps {
+			err = conn.DelRule(jump)
+			if err != nil {
+				return err
+			}
+		}
+		conn.FlushChain(chain)
+		conn.DelChain(chain)
+	}
+	sets, err := conn.GetSets(table)
+	if err != nil {
+		return err
+	}
+	for _, set := range sets {
+		if set.Name == b.addressSet(table, f).Name || b.isPortSet(f, set.Name) {
+			conn.DelSet(set)
+		}
+	}
+	err = conn.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to delete chain: %w", err)
+	}
+	return nil
+}
+
+// Collect uninstalls the container chains that aren't kept, and the sets of the chains that are already gone
+func (b nftablesBackend) Collect(v6 bool, keep []string) (removed []string, err error) {
+	conn, done, err := b.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	table, err := conn.ListTableOfFamily(nftTable, nftFamily(v6))
+	if err != nil {
+		// no table, nothing was ever installed in that family
+		return nil, nil
+	}
+	chains, err := conn.ListChainsOfTableFamily(nftFamily(v6))
+	if err != nil {
+		return nil, err
+	}
+	sets, err := conn.GetSets(table)
+	if err != nil {
+		return nil, err
+	}
+	installed := make([]string, 0, len(chains))
+	for _, chain := range chains {
+		if chain.Table.Name == nftTable {
+			installed = append(installed, chain.Name)
+		}
+	}
+	for _, set := range sets {
+		if match := nftSetPattern.FindStringSubmatch(set.Name); match != nil {
+			installed = append(installed, match[1])
+		}
+	}
+	for _, chain := range installed {
+		if !strings.HasPrefix(chain, chainPrefix) || slices.Contains(keep, chain) || slices.Contains(removed, chain) {
+			continue
+		}
+		log.Info("collecting orphaned chain ", chain)
+		err = b.Uninstall(Firewall{Chain: chain, IPv6: v6})
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, chain)
+	}
+	return removed, nil
+}
+
+// Teardown deletes the serverbench tables, with every chain and set they hold, in a single transaction
+func (b nftablesBackend) Teardown() error {
+	conn, done, err := b.conn()
+	if err != nil {
+		return err
+	}
+	defer done()
+	for _, v6 := range []bool{false, true} {
+		table, err := conn.ListTableOfFamily(nftTable, nftFamily(v6))
+		if err != nil {
+			continue
+		}
+		conn.DelTable(table)
+	}
+	err = conn.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to delete tables: %w", err)
+	}
+	return nil
+}
+
+// inputChain is the base chain of the host firewall, it filters the input of the host itself
+func (b nftablesBackend) inputChain(table *nftables.Table) *nftables.Chain {
+	policy := nftables.ChainPolicyAccept
+	return &nftables.Chain{
+		Name:     nftInput,
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	}
+}
+
+// interfaceMatch matches the input interface, a trailing + matches any suffix like in iptables
+func interfaceMatch(name string) []expr.Any {
+	data := []byte(name + "\x00")
+	if prefix, found := strings.CutSuffix(name, "+"); found {
+		data = []byte(prefix)
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+	}
+}
+
+// hostSet adds an interval set holding remotes of the host chain to the transaction
+func (b nftablesBackend) hostSet(conn *nftables.Conn, chain *nftables.Chain, v6 bool, name string, remotes []string) (set *nftables.Set, err error) {
+	elements, err := remoteElements(remotes)
+	if err != nil {
+		return nil, err
+	}
+	set = b.addressSet(chain.Table, Firewall{IPv6: v6})
+	set.Name = chain.Name + "-" + name
+	set.Interval = true
+	err = conn.AddSet(set, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.FlushSet(set)
+	return set, conn.SetAddElements(set, elements)
+}
+
+// InstallHost replaces the rules and the sets of the host chain in a single transaction
+func (b nftablesBackend) InstallHost(h HostFirewall, v6 bool) (err error) {
+	conn, done, err := b.conn()
+	if err != nil {
+		return err
+	}
+	defer done()
+	log.Info("installing host chain")
+	table := conn.AddTable(b.table(Firewall{IPv6: v6}))
+	chain := conn.AddChain(b.inputChain(table))
+	err = conn.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to create host chain: %w", err)
+	}
+	sets, err := conn.GetSets(table)
+	if err != nil {
+		return err
+	}
+	conn.FlushChain(chain)
+	rule := func(exprs ...expr.Any) {
+		conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: exprs})
+	}
+	for _, iface := range hostInterfaces {
+		rule(append(interfaceMatch(iface), verdict(Accept))...)
+	}
+	rule(append(ctState(expr.CtStateBitESTABLISHED|expr.CtStateBitRELATED), verdict(Accept))...)
+	icmp := byte(unix.IPPROTO_ICMP)
+	if v6 {
+		// neighbor discovery goes through ICMPv6, the host is unreachable without it
+		icmp = unix.IPPROTO_ICMPV6
+	}
+	rule(
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{icmp}},
+		verdict(Accept),
+	)
+	used := make(map[string]struct{})
+	if admins := familyRemotes(h.Admins, v6); len(admins) > 0 {
+		set, err := b.hostSet(conn, chain, v6, "admins", admins)
+		if err != nil {
+			return err
+		}
+		used[set.Name] = struct{}{}
+		rule(
+			addressPayload(v6, true),
+			&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+			verdict(Accept),
+		)
+	}
+	for i, port := range h.Ports {
+		unmatchPolicy := Drop
+		if port.Policy == Drop {
+			unmatchPolicy = Accept
+		}
+		var set *nftables.Set
+		if remotes := port.remotes(v6); len(remotes) > 0 {
+			set, err = b.hostSet(conn, chain, v6, nftRemotesSet+"-"+strconv.Itoa(i), remotes)
+			if err != nil {
+				return err
+			}
+			used[set.Name] = struct{}{}
+		}
+		for _, protocol := range port.protocols() {
+			match := append([]expr.Any{
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nftProtocols[protocol]}},
+			}, destinationPort(port)...)
+			if set != nil {
+				rule(append(slices.Clone(match),
+					addressPayload(v6, true),
+					&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+					verdict(unmatchPolicy),
+				)...)
+			}
+			rule(append(match, verdict(port.Policy))...)
+		}
+	}
+	rule(verdict(h.Policy))
+	// sets of removed ports, the chain flush released them
+	for _, existing := range sets {
+		if _, ok := used[existing.Name]; !ok && strings.HasPrefix(existing.Name, nftInput+"-") {
+			conn.DelSet(existing)
+		}
+	}
+	err = conn.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to install host chain: %w", err)
+	}
+	return nil
+}
+
+func (b nftablesBackend) UninstallHost(v6 bool) (err error) {
+	conn, done, err := b.conn()
+	if err != nil {
+		return err
+	}
+	defer done()
+	table, err := conn.ListTableOfFamily(nftTable, nftFamily(v6))
+	if err != nil {
+		return nil
+	}
+	chain, err := conn.ListChain(table, nftInput)
+	if err != nil {
+		return nil
+	}
+	log.Info("uninstalling host chain")
+	conn.FlushChain(chain)
+	conn.DelChain(chain)
+	sets, err := conn.GetSets(table)
+	if err != nil {
+		return err
+	}
+	for _, set := range sets {
+		if strings.HasPrefix(set.Name, nftInput+"-") {
+			conn.DelSet(set)
+		}
+	}
+	err = conn.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to delete host chain: %w", err)
+	}
+	return nil
+}
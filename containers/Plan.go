@@ -0,0 +1,167 @@
+package containers
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// FirewallPlan is what installing the firewall of an address family would change, computed without
+// touching the host
+type FirewallPlan struct {
+	Family    string    `json:"family"`
+	Chain     string    `json:"chain"`
+	Added     []string  `json:"added"`
+	Removed   []string  `json:"removed"`
+	Unchanged []string  `json:"unchanged"`
+	Sets      []SetPlan `json:"sets"`
+}
+
+// SetPlan is what installing the firewall would change in a set, the rules referencing it may not change
+type SetPlan struct {
+	Set     string   `json:"set"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// Changed reports whether installing the firewall would change anything
+func (p FirewallPlan) Changed() bool {
+	return len(p.Added) > 0 || len(p.Removed) > 0 || len(p.Sets) > 0
+}
+
+// diffRules sorts the rules into added, removed and unchanged ones. Rules are compared by their key, installed
+// rules may be listed differently than they were added
+func diffRules(plan *FirewallPlan, installed []string, desired []string, key func(rule string) string) {
+	pool := make(map[string][]string)
+	for _, rule := range installed {
+		pool[key(rule)] = append(pool[key(rule)], rule)
+	}
+	plan.Added, plan.Removed, plan.Unchanged = make([]string, 0), make([]string, 0), make([]string, 0)
+	for _, rule := range desired {
+		k := key(rule)
+		if len(pool[k]) > 0 {
+			pool[k] = pool[k][1:]
+			plan.Unchanged = append(plan.Unchanged, rule)
+		} else {
+			plan.Added = append(plan.Added, rule)
+		}
+	}
+	// in the installed order
+	for _, rule := range installed {
+		k := key(rule)
+		if len(pool[k]) > 0 {
+			pool[k] = pool[k][1:]
+			plan.Removed = append(plan.Removed, rule)
+		}
+	}
+}
+
+// diffSet adds the plan of a set when its elements would change
+func diffSet(plan *FirewallPlan, set string, installed []string, desired []string) {
+	setPlan := SetPlan{
+		Set:     set,
+		Added:   make([]string, 0),
+		Removed: make([]string, 0),
+	}
+	// allowlists can be large
+	installedSet := make(map[string]struct{}, len(installed))
+	for _, element := range installed {
+		installedSet[element] = struct{}{}
+	}
+	desiredSet := make(map[string]struct{}, len(desired))
+	for _, element := range desired {
+		desiredSet[element] = struct{}{}
+		if _, ok := installedSet[element]; !ok {
+			setPlan.Added = append(setPlan.Added, element)
+		}
+	}
+	for _, element := range installed {
+		if _, ok := desiredSet[element]; !ok {
+			setPlan.Removed = append(setPlan.Removed, element)
+		}
+	}
+	if len(setPlan.Added) > 0 || len(setPlan.Removed) > 0 {
+		plan.Sets = append(plan.Sets, setPlan)
+	}
+}
+
+// String returns the range as a prefix when it is one, as first-last otherwise
+func (r remoteRange) String() string {
+	for bits := 0; bits <= r.First.BitLen(); bits++ {
+		prefix := netip.PrefixFrom(r.First, bits)
+		if prefix.Masked().Addr() == r.First && lastAddress(prefix) == r.Last {
+			return prefix.String()
+		}
+	}
+	return r.First.String() + "-" + r.Last.String()
+}
+
+// splitRule splits a listed rule into its words, double quoted words may contain spaces
+func splitRule(rule string) (words []string) {
+	var word strings.Builder
+	quoted, escaped, started := false, false, false
+	for _, r := range rule {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quoted:
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+			started = true
+		case r == ' ' && !quoted:
+			if started {
+				words = append(words, word.String())
+				word.Reset()
+				started = false
+			}
+		default:
+			word.WriteRune(r)
+			started = true
+		}
+	}
+	if started {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// joinRule formats rule words the way iptables lists them, quoting the words with spaces
+func joinRule(words []string) string {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		if strings.ContainsAny(word, " \"") {
+			word = fmt.Sprintf("%q", word)
+		}
+		quoted = append(quoted, word)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// PlanFirewall returns what installing the firewall with the ports would change, per address family
+func (c *Container) PlanFirewall(ports []Port) (plans []FirewallPlan, err error) {
+	proposed := *c
+	proposed.Ports = ports
+	err = proposed.validatePorts()
+	if err != nil {
+		return nil, err
+	}
+	firewalls, err := c.firewalls(ports)
+	if err != nil {
+		return nil, err
+	}
+	for _, firewall := range firewalls {
+		plan, err := firewallBackend().Plan(firewall)
+		if err != nil {
+			return nil, err
+		}
+		plan.Family = "ipv4"
+		if firewall.IPv6 {
+			plan.Family = "ipv6"
+		}
+		plan.Chain = firewall.Chain
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
@@ -1,10 +1,143 @@
 package containers
 
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
 const Drop = "DROP"
 const Accept = "ACCEPT"
 
 type Port struct {
-	Port    int      `json:"port"`
-	Policy  string   `json:"policy"` // drop or accept
-	Remotes []string `json:"remotes"`
+	Port      int      `json:"port"`
+	End       int      `json:"end"`      // last port of a range, a single port when 0
+	Target    int      `json:"target"`   // first port inside the container, the host port when 0
+	Protocol  string   `json:"protocol"` // tcp or udp, both when empty
+	Policy    string   `json:"policy"`   // drop or accept
+	Remotes   []string `json:"remotes"`
+	Countries []string `json:"countries"` // ISO 3166 codes, their networks in the geoip database are remotes too
+	Limits    *Limits  `json:"limits"`    // applied to every remote, before the remotes and the policy
+}
+
+// protocols returns the protocols the port is published on
+func (p Port) protocols() []string {
+	if p.Protocol == "" {
+		return protocols
+	}
+	return []string{p.Protocol}
+}
+
+// last returns the last host port of the range
+func (p Port) last() int {
+	if p.End == 0 {
+		return p.Port
+	}
+	return p.End
+}
+
+// target returns the container port the host port is mapped to
+func (p Port) target(hostPort int) int {
+	if p.Target == 0 {
+		return hostPort
+	}
+	return p.Target + hostPort - p.Port
+}
+
+// portMatch returns the host port (or range) in the iptables port[:port] format
+func (p Port) portMatch() string {
+	if p.last() == p.Port {
+		return strconv.Itoa(p.Port)
+	}
+	return fmt.Sprintf("%d:%d", p.Port, p.last())
+}
+
+func (p Port) validate() error {
+	if p.Port < 1 || p.last() > 65535 || p.last() < p.Port {
+		return fmt.Errorf("invalid port range %d-%d", p.Port, p.last())
+	}
+	if p.Target < 0 || p.target(p.last()) > 65535 {
+		return fmt.Errorf("invalid target port %d for port %d", p.Target, p.Port)
+	}
+	if p.Protocol != "" && p.Protocol != tcp && p.Protocol != udp {
+		return fmt.Errorf("invalid protocol %q for port %d", p.Protocol, p.Port)
+	}
+	if p.Policy != Drop && p.Policy != Accept {
+		return fmt.Errorf("invalid policy %q for port %d", p.Policy, p.Port)
+	}
+	for _, remote := range p.Remotes {
+		_, err := parseRemote(remote)
+		if err != nil {
+			return fmt.Errorf("%w for port %d", err, p.Port)
+		}
+	}
+	err := validateCountries(p.Countries)
+	if err != nil {
+		return fmt.Errorf("%w for port %d", err, p.Port)
+	}
+	if p.Limits != nil {
+		err := p.Limits.validate()
+		if err != nil {
+			return fmt.Errorf("%w for port %d", err, p.Port)
+		}
+	}
+	return nil
+}
+
+// Socket is a host port published on an address
+type Socket struct {
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+func (s Socket) String() string {
+	return net.JoinHostPort(s.Address, strconv.Itoa(s.Port)) + "/" + s.Protocol
+}
+
+// Sockets returns every host port of the range published on the address
+func (p Port) Sockets(address string) []Socket {
+	sockets := make([]Socket, 0)
+	for _, protocol := range p.protocols() {
+		for hostPort := p.Port; hostPort <= p.last(); hostPort++ {
+			sockets = append(sockets, Socket{
+				Address:  address,
+				Port:     hostPort,
+				Protocol: protocol,
+			})
+		}
+	}
+	return sockets
+}
+
+// Sockets returns the host ports the container publishes, on every address
+func (c *Container) Sockets() []Socket {
+	sockets := make([]Socket, 0)
+	for _, address := range c.addresses() {
+		for _, p := range c.Ports {
+			sockets = append(sockets, p.Sockets(address)...)
+		}
+	}
+	return sockets
+}
+
+// validatePorts rejects invalid ports and host ports published twice on the same protocol
+func (c *Container) validatePorts() error {
+	published := make(map[string]struct{})
+	for _, p := range c.Ports {
+		err := p.validate()
+		if err != nil {
+			return err
+		}
+		for _, protocol := range p.protocols() {
+			for hostPort := p.Port; hostPort <= p.last(); hostPort++ {
+				key := fmt.Sprintf("%d/%s", hostPort, protocol)
+				if _, exists := published[key]; exists {
+					return fmt.Errorf("port %s is published twice", key)
+				}
+				published[key] = struct{}{}
+			}
+		}
+	}
+	return nil
 }
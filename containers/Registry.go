@@ -0,0 +1,151 @@
+package containers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/registry"
+	log "github.com/sirupsen/logrus"
+)
+
+const dockerHub = "docker.io"
+
+// machine-level credential store, in the docker config.json format
+const defaultRegistryAuthFile = "/keys/registries.json"
+
+// RegistryCredentials authenticates image pulls against a registry host
+type RegistryCredentials struct {
+	Server   string `json:"server"` // registry host, e.g. ghcr.io
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Token    string `json:"token"` // access token (GHCR, Docker Hub), used instead of the password of the username
+}
+
+// String keeps credentials out of logs
+func (r RegistryCredentials) String() string {
+	return "{" + r.Server + " <redacted>}"
+}
+
+func (r RegistryCredentials) GoString() string {
+	return r.String()
+}
+
+type registryStore struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+		RegistryToken string `json:"registrytoken"`
+	} `json:"auths"`
+}
+
+// normalizeRegistry reduces a registry address to its host, docker hub aliases are merged
+func normalizeRegistry(server string) string {
+	server = strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	server = strings.SplitN(server, "/", 2)[0]
+	switch server {
+	case "", "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return dockerHub
+	}
+	return strings.ToLower(server)
+}
+
+func registryHost(image string) (host string, err error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference %q: %w", image, err)
+	}
+	return normalizeRegistry(reference.Domain(named)), nil
+}
+
+// machineCredentials looks up the credentials of a registry host in the machine-level store
+func machineCredentials(host string) (auth *registry.AuthConfig, err error) {
+	path := os.Getenv("REGISTRY_AUTH_FILE")
+	if path == "" {
+		path = defaultRegistryAuthFile
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	store := registryStore{}
+	err = json.Unmarshal(raw, &store)
+	if err != nil {
+		// the decoding error is not wrapped, as it may quote parts of the file
+		return nil, errors.New("malformed registry credential store " + path)
+	}
+	for server, entry := range store.Auths {
+		if normalizeRegistry(server) != host {
+			continue
+		}
+		auth = &registry.AuthConfig{
+			Username:      entry.Username,
+			Password:      entry.Password,
+			IdentityToken: entry.IdentityToken,
+			RegistryToken: entry.RegistryToken,
+			ServerAddress: server,
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, errors.New("malformed auth entry for " + server)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return nil, errors.New("malformed auth entry for " + server)
+			}
+			auth.Username, auth.Password = parts[0], parts[1]
+		}
+		return auth, nil
+	}
+	return nil, nil
+}
+
+// registryAuth returns the encoded credentials for pulling the image, the container spec takes
+// precedence over the machine-level store. an empty string means anonymous pulls
+func (c *Container) registryAuth(image string) (encoded string, err error) {
+	host, err := registryHost(image)
+	if err != nil {
+		return "", err
+	}
+	var auth *registry.AuthConfig
+	for _, credentials := range c.Registries {
+		if normalizeRegistry(credentials.Server) == host {
+			auth = &registry.AuthConfig{
+				Username:      credentials.Username,
+				Password:      credentials.Password,
+				ServerAddress: credentials.Server,
+			}
+			// registries take access tokens as the password of the user, docker only sends registry tokens
+			// (short-lived bearer tokens) as is
+			if credentials.Token != "" {
+				if credentials.Username == "" {
+					return "", errors.New("the token of registry " + host + " has no username")
+				}
+				auth.Password = credentials.Token
+			}
+			break
+		}
+	}
+	if auth == nil {
+		auth, err = machineCredentials(host)
+		if err != nil {
+			return "", err
+		}
+	}
+	if auth == nil {
+		log.Info("no credentials for registry ", host, ", pulling anonymously")
+		return "", nil
+	}
+	log.Info("using credentials for registry ", host)
+	return registry.EncodeAuthConfig(*auth)
+}
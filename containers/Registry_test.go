@@ -0,0 +1,246 @@
+package containers
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+)
+
+const (
+	registryUser  = "serverbench"
+	registryToken = "registry-token"
+	// bcrypt hash of registryToken, registry:2 only reads bcrypt htpasswd files
+	registryHtpasswd = registryUser + ":$2b$12$Z0/X/L4h1iHR.ouFt040GO.ajzdiVhH1JcHvsx09QtZGmH8lQcLxm\n"
+)
+
+// decodeAuth decodes the credentials registryAuth returns, nil for anonymous pulls
+func decodeAuth(t *testing.T, c Container, image string) *registry.AuthConfig {
+	t.Helper()
+	encoded, err := c.registryAuth(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded == "" {
+		return nil
+	}
+	auth, err := registry.DecodeAuthConfig(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+func TestRegistryAuth(t *testing.T) {
+	store := filepath.Join(t.TempDir(), "registries.json")
+	t.Setenv("REGISTRY_AUTH_FILE", store)
+	err := os.WriteFile(store, []byte(`{"auths": {
+		"https://index.docker.io/v1/": {"auth": "aHViOmh1Yi1wYXNzd29yZA=="},
+		"registry.example.com:5000": {"username": "machine", "password": "machine-password"}
+	}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := Container{Registries: []RegistryCredentials{
+		{Server: "ghcr.io", Username: "octocat", Token: "ghp_token"},
+		{Server: "https://Registry.Example.com:5000/v2/", Username: "spec", Password: "spec-password"},
+	}}
+	tests := []struct {
+		image    string
+		username string
+		password string
+	}{
+		{"ghcr.io/octocat/private:latest", "octocat", "ghp_token"},
+		{"registry.example.com:5000/team/app", "spec", "spec-password"},
+		{"private/app", "hub", "hub-password"},
+		{"docker.io/library/alpine:3", "hub", "hub-password"},
+	}
+	for _, test := range tests {
+		auth := decodeAuth(t, c, test.image)
+		if auth == nil {
+			t.Errorf("%s: pulled anonymously", test.image)
+			continue
+		}
+		if auth.Username != test.username || auth.Password != test.password {
+			t.Errorf("%s: got %s:%s, expected %s:%s", test.image, auth.Username, auth.Password, test.username, test.password)
+		}
+		if auth.RegistryToken != "" || auth.IdentityToken != "" {
+			t.Errorf("%s: unexpected tokens %q %q", test.image, auth.RegistryToken, auth.IdentityToken)
+		}
+	}
+	if auth := decodeAuth(t, c, "quay.io/team/app"); auth != nil {
+		t.Errorf("quay.io: expected an anonymous pull, got %s", auth.Username)
+	}
+
+	tokenOnly := Container{Registries: []RegistryCredentials{{Server: "ghcr.io", Token: "ghp_token"}}}
+	_, err = tokenOnly.registryAuth("ghcr.io/octocat/private")
+	if err == nil {
+		t.Error("a token without username was accepted")
+	}
+
+	credentials := RegistryCredentials{Server: "ghcr.io", Username: "octocat", Password: "secret", Token: "ghp_token"}
+	for _, formatted := range []string{fmt.Sprint(credentials), fmt.Sprintf("%+v", credentials), fmt.Sprintf("%#v", credentials)} {
+		if strings.Contains(formatted, "secret") || strings.Contains(formatted, "ghp_token") || strings.Contains(formatted, "octocat") {
+			t.Errorf("credentials leak in %s", formatted)
+		}
+	}
+}
+
+// drain reads a push or pull stream, failures reported inside the stream are returned as errors
+func drain(stream io.ReadCloser, ref string) error {
+	defer stream.Close()
+	return readPullStream(stream, ref, nil)
+}
+
+// pullPublic pulls a public image without tracking it
+func pullPublic(cli *client.Client, ref string) error {
+	stream, err := cli.ImagePull(context.Background(), ref, image.PullOptions{})
+	if err != nil {
+		return err
+	}
+	return drain(stream, ref)
+}
+
+// startRegistry runs a registry:2 container requiring the test credentials and returns its address
+func startRegistry(t *testing.T, cli *client.Client) string {
+	t.Helper()
+	ctx := context.Background()
+	err := pullPublic(cli, "registry:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := cli.ContainerCreate(ctx, &container.Config{
+		Image: "registry:2",
+		Env: []string{
+			"REGISTRY_AUTH=htpasswd",
+			"REGISTRY_AUTH_HTPASSWD_REALM=serverbench",
+			"REGISTRY_AUTH_HTPASSWD_PATH=/auth/htpasswd",
+		},
+		ExposedPorts: nat.PortSet{"5000/tcp": {}},
+	}, &container.HostConfig{
+		// docker pulls from loopback registries over plain http
+		PortBindings: nat.PortMap{"5000/tcp": {{HostIP: "127.0.0.1"}}},
+	}, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cli.ContainerRemove(context.Background(), created.ID, container.RemoveOptions{Force: true})
+	})
+	// copied rather than bound, the docker daemon may not see the test files
+	var archive bytes.Buffer
+	writer := tar.NewWriter(&archive)
+	err = writer.WriteHeader(&tar.Header{Name: "auth/htpasswd", Mode: 0644, Size: int64(len(registryHtpasswd))})
+	if err == nil {
+		_, err = writer.Write([]byte(registryHtpasswd))
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = cli.CopyToContainer(ctx, created.ID, "/", &archive, container.CopyToContainerOptions{})
+	}
+	if err == nil {
+		err = cli.ContainerStart(ctx, created.ID, container.StartOptions{})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	inspect, err := cli.ContainerInspect(ctx, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindings := inspect.NetworkSettings.Ports["5000/tcp"]
+	if len(bindings) == 0 {
+		t.Fatal("the registry port isn't published")
+	}
+	return "127.0.0.1:" + bindings[0].HostPort
+}
+
+// TestPrivateRegistry pulls from a local registry:2 requiring credentials, it needs a docker daemon
+func TestPrivateRegistry(t *testing.T) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err == nil {
+		_, err = cli.Ping(context.Background())
+	}
+	if err != nil {
+		t.Skipf("docker isn't available: %v", err)
+	}
+	defer cli.Close()
+	t.Setenv("STATE_DIR", t.TempDir())
+	t.Setenv("REGISTRY_AUTH_FILE", filepath.Join(t.TempDir(), "registries.json"))
+	ctx := context.Background()
+	host := startRegistry(t, cli)
+
+	err = pullPublic(cli, "hello-world:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := host + "/private/hello:latest"
+	err = cli.ImageTag(ctx, "hello-world:latest", ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := registry.EncodeAuthConfig(registry.AuthConfig{Username: registryUser, Password: registryToken, ServerAddress: host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the registry takes a moment to listen
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		var push io.ReadCloser
+		push, err = cli.ImagePush(ctx, ref, image.PushOptions{RegistryAuth: auth})
+		if err == nil {
+			err = drain(push, ref)
+		}
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		credentials []RegistryCredentials
+		pulled      bool
+	}{
+		{"anonymous", nil, false},
+		{"password", []RegistryCredentials{{Server: host, Username: registryUser, Password: registryToken}}, true},
+		{"token", []RegistryCredentials{{Server: host, Username: registryUser, Token: registryToken}}, true},
+		{"wrong token", []RegistryCredentials{{Server: host, Username: registryUser, Token: "wrong"}}, false},
+		{"other registry", []RegistryCredentials{{Server: "ghcr.io", Username: registryUser, Token: registryToken}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := cli.ImageRemove(ctx, ref, image.RemoveOptions{})
+			if err != nil && !client.IsErrNotFound(err) {
+				t.Fatal(err)
+			}
+			c := Container{Image: ref, Registries: test.credentials}
+			err = c.pullImage(cli, nil)
+			if test.pulled && err != nil {
+				t.Errorf("pull failed: %v", err)
+			}
+			if !test.pulled && err == nil {
+				t.Error("pulled without valid credentials")
+			}
+		})
+	}
+	_, _ = cli.ImageRemove(ctx, ref, image.RemoveOptions{})
+}
@@ -0,0 +1,86 @@
+package containers
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+)
+
+// remoteRange is an inclusive range of remote addresses
+type remoteRange struct {
+	First netip.Addr
+	Last  netip.Addr
+}
+
+// parseRemote parses a remote address or CIDR
+func parseRemote(remote string) (prefix netip.Prefix, err error) {
+	prefix, err = netip.ParsePrefix(remote)
+	if err == nil {
+		return prefix.Masked(), nil
+	}
+	address, err := netip.ParseAddr(remote)
+	if err != nil {
+		return prefix, fmt.Errorf("invalid remote %q", remote)
+	}
+	return netip.PrefixFrom(address, address.BitLen()), nil
+}
+
+// lastAddress returns the last address of a prefix
+func lastAddress(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 0x80 >> (bit % 8)
+	}
+	last, _ := netip.AddrFromSlice(bytes)
+	return last
+}
+
+// familyRemotes returns the remotes that belong to the address family
+func familyRemotes(remotes []string, v6 bool) []string {
+	family := make([]string, 0, len(remotes))
+	for _, remote := range remotes {
+		if isIPv6(remote) == v6 {
+			family = append(family, remote)
+		}
+	}
+	return family
+}
+
+// remotes returns the remotes of the port that belong to the address family, with the networks of its
+// countries
+func (p Port) remotes(v6 bool) []string {
+	return append(familyRemotes(p.Remotes, v6), countryRemotes(p.Countries, v6)...)
+}
+
+// remoteRanges merges the remotes into sorted, non overlapping ranges, as required by interval sets
+func remoteRanges(remotes []string) (ranges []remoteRange, err error) {
+	for _, remote := range remotes {
+		prefix, err := parseRemote(remote)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, remoteRange{
+			First: prefix.Addr(),
+			Last:  lastAddress(prefix),
+		})
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].First.Less(ranges[j].First)
+	})
+	merged := make([]remoteRange, 0, len(ranges))
+	for _, r := range ranges {
+		if len(merged) > 0 {
+			previous := &merged[len(merged)-1]
+			// adjacent ranges are merged too, the next address of the last one is invalid
+			next := previous.Last.Next()
+			if !next.IsValid() || !next.Less(r.First) {
+				if previous.Last.Less(r.Last) {
+					previous.Last = r.Last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged, nil
+}
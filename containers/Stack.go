@@ -0,0 +1,189 @@
+package containers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// stack members are labelled with their stack, and with the hash of their spec: stacks have no update action,
+// a member is updated when the stack changes its spec
+const (
+	stackLabel = "io.serverbench.stack"
+	specLabel  = "io.serverbench.spec"
+)
+
+// Stack groups containers that are managed as a unit: they share a private network, and are started
+// in dependency order and stopped in reverse order
+type Stack struct {
+	Id           string            `json:"id"`
+	Containers   []Container       `json:"containers"`
+	Compose      *string           `json:"compose"` // docker-compose yaml, translated into containers when provided
+	Address      string            `json:"address"` // defaults for the containers translated from compose
+	Addresses    []string          `json:"addresses"`
+	Mount        string            `json:"mount"`
+	Label        Label             `json:"label"`
+	Replacements map[string]string `json:"replacements"`
+}
+
+// Validate checks the stack before any of its members is touched
+func (s *Stack) Validate() (err error) {
+	if !networkGroupPattern.MatchString(s.Id) {
+		return fmt.Errorf("invalid stack id %q", s.Id)
+	}
+	if s.Compose != nil && *s.Compose != "" && len(s.Replacements) == 0 {
+		return fmt.Errorf("stack %s has no replacements", s.Id)
+	}
+	for _, member := range s.Containers {
+		if len(member.Replacements) == 0 {
+			return fmt.Errorf("stack member %s of %s has no replacements", member.Id, s.Id)
+		}
+	}
+	return nil
+}
+
+// specHash identifies the spec of a stack member, as created. The template is applied to a copy, which
+// gives the same hash before and after the member is created as applyTemplate is idempotent
+func (c *Container) specHash() string {
+	spec := *c
+	err := spec.applyTemplate()
+	if err != nil {
+		return ""
+	}
+	spec.ExpectingFirstCommit = false
+	raw, err := json.Marshal(spec)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// SpecChanged reports whether the docker container of a stack member was created from another spec, or
+// doesn't exist
+func (c *Container) SpecChanged(cli *client.Client) (changed bool, err error) {
+	cid, err := c.cId(cli)
+	if errors.Is(err, unknownContainer) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	inspect, err := cli.ContainerInspect(context.Background(), cid)
+	if err != nil {
+		return false, err
+	}
+	return inspect.Config.Labels[specLabel] != c.specHash(), nil
+}
+
+// Members returns the containers of the stack in start order
+func (s *Stack) Members() (members []Container, err error) {
+	members = s.Containers
+	if s.Compose != nil && *s.Compose != "" {
+		members, err = s.translateCompose(*s.Compose)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compose file for stack %s: %w", s.Id, err)
+		}
+	}
+	for i := range members {
+		stack := s.Id
+		// every member shares the stack network, not a group one
+		members[i].Stack = &stack
+		members[i].Network = nil
+	}
+	return sortMembers(members)
+}
+
+// sortMembers orders the members so every container comes after its dependencies
+func sortMembers(members []Container) (sorted []Container, err error) {
+	byId := make(map[string]Container)
+	for _, member := range members {
+		if _, exists := byId[member.Id]; exists {
+			return nil, fmt.Errorf("duplicate stack member %s", member.Id)
+		}
+		byId[member.Id] = member
+	}
+	for _, member := range members {
+		for _, dependency := range member.DependsOn {
+			if _, exists := byId[dependency]; !exists {
+				return nil, fmt.Errorf("stack member %s depends on unknown member %s", member.Id, dependency)
+			}
+		}
+	}
+	// depth-first, following the declaration order so the result is stable
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var visit func(member Container) error
+	visit = func(member Container) error {
+		switch state[member.Id] {
+		case visiting:
+			return errors.New("dependency cycle on stack member " + member.Id)
+		case visited:
+			return nil
+		}
+		state[member.Id] = visiting
+		for _, dependency := range member.DependsOn {
+			err := visit(byId[dependency])
+			if err != nil {
+				return err
+			}
+		}
+		state[member.Id] = visited
+		sorted = append(sorted, member)
+		return nil
+	}
+	for _, member := range members {
+		err = visit(member)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+func (s *Stack) Start(cli *client.Client) (err error) {
+	log.Info("starting stack ", s.Id)
+	members, err := s.Members()
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		err = member.Start(cli)
+		if err != nil {
+			return fmt.Errorf("error starting stack member %s: %w", member.Id, err)
+		}
+	}
+	return nil
+}
+
+func (s *Stack) Stop(cli *client.Client) (err error) {
+	log.Info("stopping stack ", s.Id)
+	members, err := s.Members()
+	if err != nil {
+		return err
+	}
+	for i := len(members) - 1; i >= 0; i-- {
+		err = members[i].Stop(cli)
+		if err != nil {
+			return fmt.Errorf("error stopping stack member %s: %w", members[i].Id, err)
+		}
+	}
+	return nil
+}
+
+func (s *Stack) Restart(cli *client.Client) (err error) {
+	err = s.Stop(cli)
+	if err != nil {
+		return err
+	}
+	return s.Start(cli)
+}
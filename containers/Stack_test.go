@@ -0,0 +1,68 @@
+package containers
+
+import "testing"
+
+func TestSpecHash(t *testing.T) {
+	stack := "shop"
+	member := Container{
+		Id:           "db",
+		Stack:        &stack,
+		Envs:         map[string]string{"A": "1"},
+		Replacements: map[string]string{"PORT": "5432"},
+		Template: &Template{
+			Image:   "postgres:16",
+			Startup: "postgres -p ${PORT}",
+			Variables: []Variable{
+				{Name: "MODE", Type: VariableString, Default: ptr("primary")},
+			},
+		},
+	}
+	hash := member.specHash()
+	if hash == "" {
+		t.Fatal("no hash")
+	}
+	if member.Image != "" || member.Command != nil || len(member.Envs) != 1 {
+		t.Error("the template was applied to the member itself")
+	}
+
+	created := member
+	err := created.applyTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	created.ExpectingFirstCommit = true
+	if created.specHash() != hash {
+		t.Error("the hash changed once the template was applied")
+	}
+
+	changed := member
+	changed.Envs = map[string]string{"A": "2"}
+	if changed.specHash() == hash {
+		t.Error("changed envs kept the hash")
+	}
+	changed = member
+	changed.Variables = map[string]string{"MODE": "replica"}
+	if changed.specHash() == hash {
+		t.Error("changed variables kept the hash")
+	}
+}
+
+func TestStackNetwork(t *testing.T) {
+	group := "shop"
+	stack := Stack{Id: "shop", Containers: []Container{{Id: "db", Network: &group}}}
+	members, err := stack.Members()
+	if err != nil {
+		t.Fatal(err)
+	}
+	standalone := Container{Id: "web", Network: &group}
+	if members[0].networkName() == standalone.networkName() {
+		t.Errorf("the group %s joins the network of the stack %s", group, stack.Id)
+	}
+	if members[0].networkName() != stackNetworkPrefix+stack.Id {
+		t.Errorf("the member joins %s", members[0].networkName())
+	}
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
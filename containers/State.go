@@ -0,0 +1,22 @@
+package containers
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// daemon state is kept outside the tenants' tree, in the persistent (and root-only) keys volume
+const defaultStateDir = "/keys/state"
+
+// StateDir returns a path inside the daemon state directory, creating the directory if needed
+func StateDir(parts ...string) (path string, err error) {
+	root := os.Getenv("STATE_DIR")
+	if root == "" {
+		root = defaultStateDir
+	}
+	err = os.MkdirAll(root, 0700)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(append([]string{root}, parts...)...), nil
+}
@@ -0,0 +1,135 @@
+package containers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// suffixes of the containers living next to sb-<id> while it is being replaced. ids never contain
+// dots, so these names can't collide with another container's name
+const (
+	nextSuffix = ".next"
+	oldSuffix  = ".old"
+)
+
+// RollbackError is returned when an update failed and the previous container was restored
+type RollbackError struct {
+	Cause error
+}
+
+func (e *RollbackError) Error() string {
+	return "rolled back to the previous container: " + e.Cause.Error()
+}
+
+func (e *RollbackError) Unwrap() error {
+	return e.Cause
+}
+
+// IsAuxiliaryName reports whether a container name (without the sb- prefix) belongs to a container
+// that only exists while sb-<id> is being replaced
+func IsAuxiliaryName(name string) bool {
+	return strings.Contains(name, ".")
+}
+
+// swapContainer stops the previous container and puts the new one in its place. A rollback starts the
+// previous container again if it was running or start is set, e.g. when the caller already stopped it
+func (c *Container) swapContainer(ctx context.Context, cli *client.Client, previous string, next string, start bool) (err error) {
+	status, statusErr := c.getStatus(cli, &ctx, &previous)
+	wasRunning := start || (statusErr == nil && (status == "running" || status == "restarting"))
+	log.Info("swapping container")
+	err = c.stop(ctx, cli, previous)
+	if err != nil {
+		return c.rollback(ctx, cli, previous, next, wasRunning, err)
+	}
+	err = cli.ContainerRename(ctx, previous, c.cName()+oldSuffix)
+	if err != nil {
+		return c.rollback(ctx, cli, previous, next, wasRunning, err)
+	}
+	err = cli.ContainerRename(ctx, next, c.cName())
+	if err != nil {
+		return c.rollback(ctx, cli, previous, next, wasRunning, err)
+	}
+	if start {
+		err = cli.ContainerStart(ctx, next, container.StartOptions{})
+		if err != nil {
+			return c.rollback(ctx, cli, previous, next, wasRunning, err)
+		}
+	}
+	log.Info("swapped container, deleting previous container")
+	return cli.ContainerRemove(ctx, previous, container.RemoveOptions{
+		Force: true,
+	})
+}
+
+// rollback removes the new container and restores the previous one, as it was before the swap
+func (c *Container) rollback(ctx context.Context, cli *client.Client, previous string, next string, wasRunning bool, cause error) (err error) {
+	log.Error("error while swapping container, rolling back: ", cause)
+	err = cli.ContainerRemove(ctx, next, container.RemoveOptions{
+		Force: true,
+	})
+	if err == nil {
+		err = c.renameTo(ctx, cli, previous, c.cName())
+	}
+	if err == nil && wasRunning {
+		err = cli.ContainerStart(ctx, previous, container.StartOptions{})
+	}
+	if err != nil {
+		log.Error("error while rolling back: ", err)
+		return fmt.Errorf("rollback failed (%v) after: %w", err, cause)
+	}
+	return &RollbackError{
+		Cause: cause,
+	}
+}
+
+func (c *Container) renameTo(ctx context.Context, cli *client.Client, cid string, name string) (err error) {
+	inspect, err := cli.ContainerInspect(ctx, cid)
+	if err != nil {
+		return err
+	}
+	if inspect.Name == "/"+name {
+		return nil
+	}
+	return cli.ContainerRename(ctx, cid, name)
+}
+
+// recoverSwap cleans up after a swap that was interrupted (e.g. the daemon was restarted midway)
+func (c *Container) recoverSwap(ctx context.Context, cli *client.Client) (err error) {
+	next, err := c.findByName(cli, c.cName()+nextSuffix)
+	if err == nil {
+		log.Info("removing leftover container from an interrupted update")
+		err = cli.ContainerRemove(ctx, next, container.RemoveOptions{
+			Force: true,
+		})
+		if err != nil {
+			return err
+		}
+	} else if !errors.Is(err, unknownContainer) {
+		return err
+	}
+	old, err := c.findByName(cli, c.cName()+oldSuffix)
+	if errors.Is(err, unknownContainer) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = c.cId(cli)
+	if errors.Is(err, unknownContainer) {
+		log.Info("restoring previous container from an interrupted update")
+		return cli.ContainerRename(ctx, old, c.cName())
+	}
+	if err != nil {
+		return err
+	}
+	log.Info("removing previous container from an interrupted update")
+	return cli.ContainerRemove(ctx, old, container.RemoveOptions{
+		Force: true,
+	})
+}
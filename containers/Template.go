@@ -0,0 +1,285 @@
+package containers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Variable types
+const (
+	VariableString = "string"
+	VariableInt    = "int"
+	VariableBool   = "bool"
+	VariableEnum   = "enum"
+)
+
+var variableNamePattern = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*$`)
+
+// Template describes an application type once (e.g. a game server), containers only provide the values of
+// its variables
+type Template struct {
+	Id          string          `json:"id"`
+	Image       string          `json:"image"`       // used when the container doesn't provide one
+	Startup     string          `json:"startup"`     // startup command, ${VAR} placeholders are substituted
+	StopCommand *string         `json:"stopCommand"` // used when the container doesn't provide one
+	Install     *InstallScript  `json:"install"`
+	Configs     []ConfigRewrite `json:"configs"`
+	Variables   []Variable      `json:"variables"`
+}
+
+// Variable is a typed template variable, exposed to the container (and the install script) as an env
+type Variable struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Default  *string  `json:"default"`
+	Required bool     `json:"required"`
+	Min      *int64   `json:"min"`     // int: smallest value, string: shortest length
+	Max      *int64   `json:"max"`     // int: largest value, string: longest length
+	Options  []string `json:"options"` // enum: accepted values
+	Pattern  *string  `json:"pattern"` // string: regular expression the whole value must match
+}
+
+// substitute replaces the ${NAME} and VAR_NAME placeholders with the values, in a single pass so a value is
+// never substituted again
+func substitute(value string, values map[string]string) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	// the longest names first, VAR_PORT2 isn't VAR_PORT followed by a 2
+	sort.Slice(keys, func(i, j int) bool {
+		return len(keys[i]) > len(keys[j])
+	})
+	pairs := make([]string, 0, len(values)*4)
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("${%s}", k), values[k], fmt.Sprintf("VAR_%s", k), values[k])
+	}
+	return strings.NewReplacer(pairs...).Replace(value)
+}
+
+// mergeValues returns the values substituted together, the first maps take precedence
+func mergeValues(maps ...map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for i := len(maps) - 1; i >= 0; i-- {
+		for k, v := range maps[i] {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// substituteWords is substitute for commands: every value is quoted as a single shell word, so a value can't
+// add arguments (placeholders must not be quoted themselves)
+func substituteWords(command string, values map[string]string) string {
+	quoted := make(map[string]string, len(values))
+	for k, v := range values {
+		quoted[k] = quoteArgs([]string{v})
+	}
+	return substitute(command, quoted)
+}
+
+func (v Variable) validate() (err error) {
+	if !variableNamePattern.MatchString(v.Name) {
+		return fmt.Errorf("invalid variable name %q", v.Name)
+	}
+	switch v.Type {
+	case VariableString:
+		if v.Pattern != nil {
+			_, err = regexp.Compile(*v.Pattern)
+			if err != nil {
+				return fmt.Errorf("invalid pattern for variable %s: %w", v.Name, err)
+			}
+		}
+	case VariableInt, VariableBool:
+	case VariableEnum:
+		if len(v.Options) == 0 {
+			return fmt.Errorf("enum variable %s has no options", v.Name)
+		}
+	default:
+		return fmt.Errorf("invalid type %q for variable %s", v.Type, v.Name)
+	}
+	if v.Default != nil {
+		err = v.check(*v.Default)
+		if err != nil {
+			return fmt.Errorf("invalid default: %w", err)
+		}
+	}
+	return nil
+}
+
+// check validates a value against the variable type and constraints
+func (v Variable) check(value string) error {
+	switch v.Type {
+	case VariableString:
+		length := int64(utf8.RuneCountInString(value))
+		if v.Min != nil && length < *v.Min {
+			return fmt.Errorf("variable %s must be at least %d characters long", v.Name, *v.Min)
+		}
+		if v.Max != nil && length > *v.Max {
+			return fmt.Errorf("variable %s must be at most %d characters long", v.Name, *v.Max)
+		}
+		if v.Pattern != nil {
+			matched, err := regexp.MatchString("^(?:"+*v.Pattern+")$", value)
+			if err != nil || !matched {
+				return fmt.Errorf("variable %s doesn't match %q", v.Name, *v.Pattern)
+			}
+		}
+	case VariableInt:
+		number, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("variable %s must be an integer", v.Name)
+		}
+		if v.Min != nil && number < *v.Min {
+			return fmt.Errorf("variable %s must be at least %d", v.Name, *v.Min)
+		}
+		if v.Max != nil && number > *v.Max {
+			return fmt.Errorf("variable %s must be at most %d", v.Name, *v.Max)
+		}
+	case VariableBool:
+		if value != "true" && value != "false" {
+			return fmt.Errorf("variable %s must be true or false", v.Name)
+		}
+	case VariableEnum:
+		if !slices.Contains(v.Options, value) {
+			return fmt.Errorf("variable %s must be one of %s", v.Name, strings.Join(v.Options, ", "))
+		}
+	}
+	return nil
+}
+
+func (t *Template) validate() (err error) {
+	names := make(map[string]struct{})
+	for _, v := range t.Variables {
+		if _, exists := names[v.Name]; exists {
+			return fmt.Errorf("variable %s is declared twice", v.Name)
+		}
+		names[v.Name] = struct{}{}
+		err = v.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if t.Install != nil {
+		err = t.Install.validate()
+		if err != nil {
+			return err
+		}
+	}
+	for _, config := range t.Configs {
+		err = config.validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve validates the provided values against the schema and fills in the defaults
+func (t *Template) resolve(values map[string]string) (resolved map[string]string, err error) {
+	err = t.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid template %s: %w", t.Id, err)
+	}
+	unknown := make([]string, 0)
+	for name := range values {
+		if !slices.ContainsFunc(t.Variables, func(v Variable) bool { return v.Name == name }) {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown variables %s", strings.Join(unknown, ", "))
+	}
+	resolved = make(map[string]string, len(t.Variables))
+	errs := make([]error, 0)
+	for _, v := range t.Variables {
+		value, provided := values[v.Name]
+		if !provided || value == "" {
+			if v.Default != nil {
+				value = *v.Default
+			} else if v.Required {
+				errs = append(errs, fmt.Errorf("variable %s is required", v.Name))
+				continue
+			}
+		}
+		// optional variables may be left empty
+		if value != "" {
+			err = v.check(value)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		resolved[v.Name] = value
+	}
+	return resolved, errors.Join(errs...)
+}
+
+// variables returns the resolved template variables, none without template
+func (c *Container) variables() (resolved map[string]string, err error) {
+	if c.Template == nil {
+		return map[string]string{}, nil
+	}
+	return c.Template.resolve(c.Variables)
+}
+
+// applyTemplate fills the container from its template: the image and stop command when none is provided,
+// the startup command unless the container has its own, and the variables as envs. It is idempotent
+func (c *Container) applyTemplate() (err error) {
+	if c.Template == nil {
+		return nil
+	}
+	variables, err := c.variables()
+	if err != nil {
+		return err
+	}
+	if c.Image == "" {
+		c.Image = c.Template.Image
+	}
+	if c.StopCommand == nil {
+		c.StopCommand = c.Template.StopCommand
+	}
+	// the validated variables take precedence over the plain envs, a new map is used as it may be shared
+	envs := make(map[string]string, len(c.Envs)+len(variables))
+	for k, v := range c.Envs {
+		envs[k] = v
+	}
+	for k, v := range variables {
+		envs[k] = v
+	}
+	c.Envs = envs
+	if c.Template.Startup != "" && c.Command == nil && len(c.Args) == 0 {
+		startup := substituteWords(c.Template.Startup, mergeValues(variables, c.Replacements))
+		c.Command = &startup
+	}
+	return nil
+}
+
+// rewriteConfigs applies the config rewrites of the template, files the application hasn't created yet
+// are rewritten on the next update
+func (c *Container) rewriteConfigs() (err error) {
+	if c.Template == nil || len(c.Template.Configs) == 0 {
+		return nil
+	}
+	variables, err := c.variables()
+	if err != nil {
+		return err
+	}
+	for _, config := range c.Template.Configs {
+		err = c.rewriteConfig(config, variables)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error rewriting %s: %w", config.Path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,415 @@
+package machine
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"supervisor/containers"
+	"supervisor/machine/hardware"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	reservationTtl   = 5 * time.Minute
+	defaultPortRange = "10000-30000"
+)
+
+// with --pid=host, the sockets of pid 1 are the host's, /proc/net/ (the daemon's namespace) is the fallback
+var socketTables = map[string][]string{
+	"tcp": {"/proc/1/net/tcp", "/proc/1/net/tcp6"},
+	"udp": {"/proc/1/net/udp", "/proc/1/net/udp6"},
+}
+
+// owners of a used port
+const (
+	OwnerHost        = "host"
+	OwnerReservation = "reservation"
+)
+
+type PortRequest struct {
+	Port     int    `json:"port"`     // preferred first port, any free one when 0
+	Count    int    `json:"count"`    // consecutive ports, 1 when 0
+	Protocol string `json:"protocol"` // tcp or udp, both when empty
+}
+
+type AllocationRequest struct {
+	Container string        `json:"container"` // the reservations are held for this container id
+	Addresses []string      `json:"addresses"` // preferred addresses, one per family otherwise
+	Families  []string      `json:"families"`  // IPv4 and/or IPv6, both when empty
+	Ports     []PortRequest `json:"ports"`
+}
+
+type Allocation struct {
+	Address   string            `json:"address"`
+	Addresses []string          `json:"addresses"`
+	Ports     []containers.Port `json:"ports"`
+	Expires   int64             `json:"expires"` // ms, reservations are released once the container is created
+}
+
+type Conflict struct {
+	containers.Socket
+	Owner string `json:"owner"` // a container, host or reservation
+}
+
+func (c Conflict) Error() string {
+	return c.Socket.String() + " is used by " + c.Owner
+}
+
+func conflictErrors(conflicts []Conflict) []error {
+	errs := make([]error, len(conflicts))
+	for i, conflict := range conflicts {
+		errs[i] = conflict
+	}
+	return errs
+}
+
+type reservation struct {
+	container string
+	expires   time.Time
+}
+
+// Allocator hands out addresses and ports that are free on the node, reservations are kept in memory until
+// the container they were made for is created
+type Allocator struct {
+	lock         sync.Mutex
+	reservations map[containers.Socket]reservation
+}
+
+func NewAllocator() *Allocator {
+	return &Allocator{
+		reservations: make(map[containers.Socket]reservation),
+	}
+}
+
+// usage maps each used socket to its owner, wildcard binds are stored under their wildcard address
+type usage map[containers.Socket]string
+
+// owner returns who uses the socket, taking wildcard binds into account: a socket bound on every address
+// conflicts with each of them, and the other way around
+func (u usage) owner(socket containers.Socket) (owner string, used bool) {
+	wildcard := "0.0.0.0"
+	if strings.Contains(socket.Address, ":") {
+		wildcard = "::"
+	}
+	if wildcard == socket.Address || socket.Address == "" {
+		for other, owner := range u {
+			if other.Port == socket.Port && other.Protocol == socket.Protocol && strings.Contains(other.Address, ":") == strings.Contains(socket.Address, ":") {
+				return owner, true
+			}
+		}
+		return "", false
+	}
+	for _, candidate := range []string{socket.Address, wildcard, ""} {
+		lookup := socket
+		lookup.Address = candidate
+		if owner, used = u[lookup]; used {
+			return owner, true
+		}
+	}
+	return "", false
+}
+
+// hexAddress decodes an address of /proc/net/{tcp,udp}[6], stored as little endian 32 bit words
+func hexAddress(encoded string) (address string, err error) {
+	raw, err := hex.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	if len(raw) != 4 && len(raw) != 16 {
+		return "", errors.New("invalid socket address")
+	}
+	for word := 0; word < len(raw); word += 4 {
+		raw[word], raw[word+1], raw[word+2], raw[word+3] = raw[word+3], raw[word+2], raw[word+1], raw[word]
+	}
+	return net.IP(raw).String(), nil
+}
+
+// hostSockets adds the listening tcp sockets and bound udp sockets of the host
+func (u usage) hostSockets() {
+	for protocol, paths := range socketTables {
+		for _, path := range paths {
+			file, err := os.Open(path)
+			if errors.Is(err, os.ErrNotExist) {
+				file, err = os.Open(strings.Replace(path, "/proc/1/", "/proc/", 1))
+			}
+			if err != nil {
+				log.Info("unable to read host sockets from ", path, ": ", err)
+				continue
+			}
+			scanner := bufio.NewScanner(file)
+			scanner.Scan() // header
+			for scanner.Scan() {
+				fields := strings.Fields(scanner.Text())
+				if len(fields) < 4 {
+					continue
+				}
+				// 0A is LISTEN for tcp, 07 is an unconnected udp socket
+				if (protocol == "tcp" && fields[3] != "0A") || (protocol == "udp" && fields[3] != "07") {
+					continue
+				}
+				local := strings.SplitN(fields[1], ":", 2)
+				if len(local) != 2 {
+					continue
+				}
+				address, err := hexAddress(local[0])
+				if err != nil {
+					continue
+				}
+				port, err := strconv.ParseInt(local[1], 16, 32)
+				if err != nil {
+					continue
+				}
+				u[containers.Socket{Address: address, Port: int(port), Protocol: protocol}] = OwnerHost
+			}
+			file.Close()
+		}
+	}
+}
+
+// usedPorts collects the ports used by the host, by every container (managed or not) and by reservations
+func (a *Allocator) usedPorts(cli *client.Client, managed []containers.Container, except string) (used usage, err error) {
+	used = make(usage)
+	used.hostSockets()
+	running, err := cli.ContainerList(context.Background(), container.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// published ports are also host listeners (the docker proxy), they're attributed to their container
+	for _, c := range running {
+		owner := strings.TrimPrefix(c.Names[0], "/")
+		if owner == prefix+except || strings.HasPrefix(owner, prefix+except+".") {
+			owner = except
+		}
+		for _, port := range c.Ports {
+			if port.PublicPort != 0 {
+				used[containers.Socket{Address: port.IP, Port: int(port.PublicPort), Protocol: port.Type}] = owner
+			}
+		}
+	}
+	// managed containers hold their ports even while stopped
+	for _, c := range managed {
+		if c.Id == except {
+			continue
+		}
+		for _, socket := range c.Sockets() {
+			used[socket] = c.Id
+		}
+	}
+	now := time.Now()
+	for socket, held := range a.reservations {
+		if held.expires.Before(now) {
+			delete(a.reservations, socket)
+			continue
+		}
+		if held.container != except {
+			used[socket] = OwnerReservation
+		}
+	}
+	for socket, owner := range used {
+		if owner == except {
+			delete(used, socket)
+		}
+	}
+	return used, nil
+}
+
+// publicAddresses returns the public addresses of the node, by family
+func publicAddresses(interfaces []hardware.Interface) map[string][]string {
+	addresses := make(map[string][]string)
+	for _, iface := range interfaces {
+		for _, address := range iface.Addresses {
+			ip, _, err := net.ParseCIDR(address.Ip)
+			if err != nil {
+				continue
+			}
+			addresses[address.Version] = append(addresses[address.Version], ip.String())
+		}
+	}
+	return addresses
+}
+
+// parseRange parses a first-last port range
+func parseRange(value string) (first int, last int, err error) {
+	bounds := strings.SplitN(value, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, errors.New("expected first-last")
+	}
+	first, err = strconv.Atoi(bounds[0])
+	if err == nil {
+		last, err = strconv.Atoi(bounds[1])
+	}
+	if err == nil && (first < 1 || last > 65535 || last < first) {
+		err = errors.New("out of bounds")
+	}
+	return first, last, err
+}
+
+// portRange returns the ports handed out when no port is requested, from ALLOCATOR_PORT_RANGE
+func portRange() (first int, last int) {
+	value := os.Getenv("ALLOCATOR_PORT_RANGE")
+	if value == "" {
+		value = defaultPortRange
+	}
+	first, last, err := parseRange(value)
+	if err != nil {
+		log.Error("invalid ALLOCATOR_PORT_RANGE ", value, ": ", err, ", using ", defaultPortRange)
+		first, last, _ = parseRange(defaultPortRange)
+	}
+	return first, last
+}
+
+// Allocate reserves addresses and ports that are free on every requested address
+func (m *Machine) Allocate(cli *client.Client, request AllocationRequest) (allocation Allocation, err error) {
+	a := m.Allocator
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	used, err := a.usedPorts(cli, m.Snapshot(), request.Container)
+	if err != nil {
+		return allocation, err
+	}
+	allocation.Addresses = request.Addresses
+	if len(allocation.Addresses) == 0 {
+		families := request.Families
+		if len(families) == 0 {
+			families = []string{"IPv4", "IPv6"}
+		}
+		available := publicAddresses(m.Hardware.Interfaces)
+		for _, family := range families {
+			if len(available[family]) > 0 {
+				allocation.Addresses = append(allocation.Addresses, available[family][0])
+			}
+		}
+	}
+	if len(allocation.Addresses) == 0 {
+		return allocation, errors.New("no public address available")
+	}
+	allocation.Address = allocation.Addresses[0]
+	first, last := portRange()
+	reserved := make([]containers.Socket, 0)
+	free := func(port containers.Port) bool {
+		for _, address := range allocation.Addresses {
+			for _, socket := range port.Sockets(address) {
+				if _, taken := used.owner(socket); taken {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	for _, portRequest := range request.Ports {
+		count := portRequest.Count
+		if count < 1 {
+			count = 1
+		}
+		port := containers.Port{
+			Protocol: portRequest.Protocol,
+			Policy:   containers.Accept,
+		}
+		candidates := []int{portRequest.Port}
+		if portRequest.Port == 0 {
+			candidates = candidates[:0]
+			for candidate := first; candidate+count-1 <= last; candidate++ {
+				candidates = append(candidates, candidate)
+			}
+		}
+		found := false
+		for _, candidate := range candidates {
+			port.Port = candidate
+			port.End = 0
+			if count > 1 {
+				port.End = candidate + count - 1
+			}
+			if free(port) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return Allocation{}, fmt.Errorf("no free port for %+v", portRequest)
+		}
+		for _, address := range allocation.Addresses {
+			for _, socket := range port.Sockets(address) {
+				used[socket] = OwnerReservation
+				reserved = append(reserved, socket)
+			}
+		}
+		allocation.Ports = append(allocation.Ports, port)
+	}
+	expires := time.Now().Add(reservationTtl)
+	for _, socket := range reserved {
+		a.reservations[socket] = reservation{
+			container: request.Container,
+			expires:   expires,
+		}
+	}
+	allocation.Expires = expires.UnixMilli()
+	return allocation, nil
+}
+
+// Conflicts returns the ports of a container that are already used by something else on the node
+func (m *Machine) Conflicts(cli *client.Client, c containers.Container) (conflicts []Conflict, err error) {
+	return m.conflicts(cli, c, m.Snapshot())
+}
+
+// conflicts checks the container against the host, every docker container and the managed containers
+func (m *Machine) conflicts(cli *client.Client, c containers.Container, managed []containers.Container) (conflicts []Conflict, err error) {
+	a := m.Allocator
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	used, err := a.usedPorts(cli, managed, c.Id)
+	if err != nil {
+		return nil, err
+	}
+	conflicts = make([]Conflict, 0)
+	for _, socket := range c.Sockets() {
+		owner, taken := used.owner(socket)
+		if taken {
+			conflicts = append(conflicts, Conflict{
+				Socket: socket,
+				Owner:  owner,
+			})
+		}
+	}
+	return conflicts, nil
+}
+
+// CheckPorts returns an error listing the ports of a container that are already used by something else,
+// e.g. before an update publishes new ports
+func (m *Machine) CheckPorts(cli *client.Client, c containers.Container) error {
+	return m.checkPorts(cli, c, m.Snapshot())
+}
+
+// checkPorts checks the container against the final managed containers, docker only reports the first port
+// already allocated
+func (m *Machine) checkPorts(cli *client.Client, c containers.Container, managed []containers.Container) error {
+	conflicts, err := m.conflicts(cli, c, managed)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("ports of %s are not available: %w", c.Id, errors.Join(conflictErrors(conflicts)...))
+	}
+	return nil
+}
+
+// release drops the reservations held for a container, once it was created
+func (a *Allocator) release(container string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for socket, held := range a.reservations {
+		if held.container == container {
+			delete(a.reservations, socket)
+		}
+	}
+}
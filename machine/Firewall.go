@@ -0,0 +1,91 @@
+package machine
+
+import (
+	log "github.com/sirupsen/logrus"
+	"supervisor/containers"
+)
+
+// FirewallDrift describes how the installed firewall of a container differed from its ports
+type FirewallDrift struct {
+	Container string   `json:"container"`
+	Drift     []string `json:"drift"`
+	Repaired  bool     `json:"repaired"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// ReconcileFirewalls compares the firewall of every container with its ports and reinstalls the ones that
+// drifted, e.g. after an iptables -F or a docker restart rewriting DOCKER-USER. Nothing is checked while the
+// containers are being updated, skipped is set then, and the containers an action runs on are left out
+func (m *Machine) ReconcileFirewalls() (drifts []FirewallDrift, skipped bool) {
+	if !m.lock.TryLock() {
+		return nil, true
+	}
+	defer m.lock.Unlock()
+	for _, c := range m.Containers {
+		if m.isActing(c.Id) {
+			continue
+		}
+		drift, err := c.FirewallDrift()
+		if err != nil {
+			log.Error("firewall check failed for ", c.Id, ": ", err)
+			continue
+		}
+		if len(drift) == 0 {
+			continue
+		}
+		log.Warn("firewall of ", c.Id, " drifted: ", drift)
+		result := FirewallDrift{
+			Container: c.Id,
+			Drift:     drift,
+		}
+		err = c.InstallFirewall()
+		if err != nil {
+			log.Error("firewall repair failed for ", c.Id, ": ", err)
+			result.Error = err.Error()
+		} else {
+			result.Repaired = true
+		}
+		drifts = append(drifts, result)
+	}
+	return drifts, false
+}
+
+// CollectFirewalls removes the chains of the containers the machine doesn't manage anymore. Nothing is
+// collected while the containers are being updated, skipped is set then
+func (m *Machine) CollectFirewalls() (removed []string, skipped bool) {
+	if !m.lock.TryLock() {
+		return nil, true
+	}
+	defer m.lock.Unlock()
+	managed := make([]string, 0, len(m.Containers))
+	for _, c := range m.Containers {
+		managed = append(managed, c.Id)
+	}
+	removed, err := containers.CollectFirewalls(managed)
+	if err != nil {
+		log.Error("firewall collection failed: ", err)
+	}
+	return removed, false
+}
+
+// FirewallCounters returns the counters of the firewall rules of every container, per address family. They
+// count from the last install of the firewall, since holds when it happened for each container
+func (m *Machine) FirewallCounters() (counters map[string]map[string][]containers.Counter, since map[string]int64) {
+	counters = make(map[string]map[string][]containers.Counter)
+	since = make(map[string]int64)
+	for _, c := range m.Snapshot() {
+		if len(c.Ports) == 0 {
+			continue
+		}
+		// read first, a reset in between shows in the next report
+		since[c.Id] = c.CountersSince()
+		containerCounters, err := c.Counters()
+		if err != nil {
+			log.Error("firewall counters failed for ", c.Id, ": ", err)
+			delete(since, c.Id)
+			continue
+		}
+		counters[c.Id] = containerCounters
+	}
+	return counters, since
+}
@@ -0,0 +1,44 @@
+package machine
+
+import (
+	log "github.com/sirupsen/logrus"
+	"supervisor/containers"
+)
+
+// RefreshGeoIP reloads the country database when it changed on disk, then reinstalls the firewalls using
+// countries
+func (m *Machine) RefreshGeoIP() (err error) {
+	changed, err := containers.RefreshGeoIP()
+	if err != nil || !changed {
+		return err
+	}
+	m.reinstallCountryFirewalls()
+	return nil
+}
+
+// UpdateGeoIP replaces the country database with the one published by the control plane
+func (m *Machine) UpdateGeoIP(update containers.GeoIPUpdate) (err error) {
+	changed, err := update.Download()
+	if err != nil || !changed {
+		return err
+	}
+	m.reinstallCountryFirewalls()
+	return nil
+}
+
+// reinstallCountryFirewalls reinstalls the firewalls using countries, their networks may have changed. It
+// waits for a running update, which may still install firewalls resolved with the previous database. The
+// containers an action runs on install theirs with the new database already
+func (m *Machine) reinstallCountryFirewalls() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, c := range m.Containers {
+		if !c.HasCountries() || m.isActing(c.Id) {
+			continue
+		}
+		err := c.InstallFirewall()
+		if err != nil {
+			log.Error("firewall reinstall failed for ", c.Id, ": ", err)
+		}
+	}
+}
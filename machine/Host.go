@@ -0,0 +1,140 @@
+package machine
+
+import (
+	log "github.com/sirupsen/logrus"
+	"reflect"
+	"supervisor/containers"
+	"time"
+)
+
+// installHostFirewall installs the host firewall, or removes it when there's none
+func installHostFirewall(firewall *containers.HostFirewall) error {
+	if firewall == nil {
+		return containers.UninstallHostFirewall()
+	}
+	return firewall.Install()
+}
+
+// ApplyHostFirewall installs the host firewall, nil removes it. A changed firewall stays pending until
+// ConfirmHostFirewall, the last confirmed one is restored if the window ends first. The deadline of the
+// pending firewall is returned, nil when it's confirmed already
+func (m *Machine) ApplyHostFirewall(firewall *containers.HostFirewall, window time.Duration) (deadline *time.Time, err error) {
+	m.hostLock.Lock()
+	defer m.hostLock.Unlock()
+	state, err := containers.ReadHostFirewallState()
+	if err != nil {
+		return nil, err
+	}
+	// reinstalled even when unchanged, the rules may be gone (e.g. after a reboot)
+	err = installHostFirewall(firewall)
+	if err != nil {
+		log.Error("host firewall install failed, restoring the installed one: ", err)
+		restoreErr := installHostFirewall(state.Installed)
+		if restoreErr != nil {
+			log.Error("host firewall restore failed: ", restoreErr)
+		}
+		return nil, err
+	}
+	if reflect.DeepEqual(state.Installed, firewall) {
+		return state.Deadline, nil
+	}
+	previous := state.Installed
+	if state.Deadline != nil {
+		// the installed one was never confirmed, the one before it is still the one to go back to
+		previous = state.Previous
+	}
+	pending := time.Now().Add(window)
+	err = containers.WriteHostFirewallState(containers.HostFirewallState{
+		Installed: firewall,
+		Previous:  previous,
+		Deadline:  &pending,
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.scheduleHostRevert(window)
+	return &pending, nil
+}
+
+// PendingHostFirewall returns the deadline of the pending host firewall, nil when it's confirmed
+func (m *Machine) PendingHostFirewall() (deadline *time.Time, err error) {
+	m.hostLock.Lock()
+	defer m.hostLock.Unlock()
+	state, err := containers.ReadHostFirewallState()
+	if err != nil {
+		return nil, err
+	}
+	return state.Deadline, nil
+}
+
+// ConfirmHostFirewall keeps the pending host firewall with the deadline, the control plane is reachable with
+// it. A firewall applied since stays pending, the round trip didn't go through it
+func (m *Machine) ConfirmHostFirewall(deadline time.Time) error {
+	m.hostLock.Lock()
+	defer m.hostLock.Unlock()
+	state, err := containers.ReadHostFirewallState()
+	if err != nil || state.Deadline == nil {
+		return err
+	}
+	if !state.Deadline.Equal(deadline) {
+		log.Info("host firewall changed since the round trip, it stays pending")
+		return nil
+	}
+	if m.hostRevert != nil {
+		m.hostRevert.Stop()
+	}
+	log.Info("host firewall confirmed")
+	return containers.WriteHostFirewallState(containers.HostFirewallState{Installed: state.Installed})
+}
+
+// ResumeHostFirewall restarts the timer of a host firewall that was pending when the daemon stopped. It's
+// reverted right away when its window is over, before the daemon tries to reach the control plane
+func (m *Machine) ResumeHostFirewall() error {
+	m.hostLock.Lock()
+	state, err := containers.ReadHostFirewallState()
+	m.hostLock.Unlock()
+	if err != nil || state.Deadline == nil {
+		return err
+	}
+	remaining := time.Until(*state.Deadline)
+	if remaining <= 0 {
+		m.revertHostFirewall()
+		return nil
+	}
+	m.hostLock.Lock()
+	defer m.hostLock.Unlock()
+	m.scheduleHostRevert(remaining)
+	return nil
+}
+
+func (m *Machine) scheduleHostRevert(after time.Duration) {
+	if m.hostRevert != nil {
+		m.hostRevert.Stop()
+	}
+	m.hostRevert = time.AfterFunc(after, m.revertHostFirewall)
+}
+
+// revertHostFirewall restores the previous host firewall, the installed one wasn't confirmed in time
+func (m *Machine) revertHostFirewall() {
+	m.hostLock.Lock()
+	defer m.hostLock.Unlock()
+	state, err := containers.ReadHostFirewallState()
+	if err != nil {
+		log.Error("host firewall revert failed: ", err)
+		return
+	}
+	// confirmed, or replaced by another firewall, meanwhile
+	if state.Deadline == nil || time.Now().Before(*state.Deadline) {
+		return
+	}
+	log.Warn("host firewall wasn't confirmed in time, reverting")
+	err = installHostFirewall(state.Previous)
+	if err != nil {
+		log.Error("host firewall revert failed: ", err)
+		return
+	}
+	err = containers.WriteHostFirewallState(containers.HostFirewallState{Installed: state.Previous})
+	if err != nil {
+		log.Error("host firewall revert failed: ", err)
+	}
+}
@@ -0,0 +1,170 @@
+package machine
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strconv"
+	"supervisor/containers"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/shirou/gopsutil/v3/disk"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultImageMinAge       = 24 * time.Hour
+	defaultImageDiskPressure = 0.85
+)
+
+// ImagePolicy decides when unreferenced images pulled by the daemon are removed
+type ImagePolicy struct {
+	MinAge       time.Duration // unreferenced images are kept at least this long
+	DiskPressure float64       // used ratio of the docker root that triggers removal regardless of age
+	DockerRoot   string        // defaults to the docker root dir reported by the engine
+}
+
+type ImageReport struct {
+	Removed   []string `json:"removed"`
+	Reclaimed int64    `json:"reclaimed"` // bytes
+}
+
+func GetImagePolicy() (policy ImagePolicy) {
+	policy = ImagePolicy{
+		MinAge:       defaultImageMinAge,
+		DiskPressure: defaultImageDiskPressure,
+		DockerRoot:   os.Getenv("DOCKER_ROOT"),
+	}
+	if minAge, err := time.ParseDuration(os.Getenv("IMAGE_GC_MIN_AGE")); err == nil {
+		policy.MinAge = minAge
+	}
+	if pressure, err := strconv.ParseFloat(os.Getenv("IMAGE_GC_DISK_PRESSURE"), 64); err == nil {
+		policy.DiskPressure = pressure
+	}
+	return policy
+}
+
+// underPressure reports whether the docker root is running out of space, unknown usage counts as no pressure
+func (p ImagePolicy) underPressure(cli *client.Client) bool {
+	root := p.DockerRoot
+	if root == "" {
+		info, err := cli.Info(context.Background())
+		if err != nil {
+			log.Error("error while retrieving docker root: ", err)
+			return false
+		}
+		root = info.DockerRootDir
+	}
+	usage, err := disk.Usage(root)
+	if err != nil {
+		log.Info("unable to read usage of ", root, ", ignoring disk pressure: ", err)
+		return false
+	}
+	return usage.UsedPercent/100 >= p.DiskPressure
+}
+
+// CollectImages removes the images pulled by the daemon that are no longer referenced by any container,
+// images that weren't pulled by the daemon are never removed. Pulled images left dangling by a newer pull
+// of their tag can't be used again, they are removed without waiting for the minimum age
+func (m *Machine) CollectImages(cli *client.Client, policy ImagePolicy) (report ImageReport, err error) {
+	report.Removed = make([]string, 0)
+	// every container counts, not only the managed ones
+	all, err := cli.ContainerList(context.Background(), container.ListOptions{
+		All: true,
+	})
+	if err != nil {
+		return report, err
+	}
+	referenced := make(map[string]struct{})
+	for _, c := range all {
+		referenced[c.ImageID] = struct{}{}
+	}
+	dangling, err := danglingImages(cli)
+	if err != nil {
+		return report, err
+	}
+	now := time.Now()
+	candidates := make([]containers.TrackedImage, 0)
+	err = containers.UpdateTrackedImages(func(images map[string]containers.TrackedImage) {
+		for id, tracked := range images {
+			if _, ok := referenced[id]; ok {
+				tracked.LastUsed = now
+				images[id] = tracked
+				continue
+			}
+			candidates = append(candidates, tracked)
+		}
+	})
+	if err != nil {
+		return report, err
+	}
+	// least recently used first, so disk pressure removes the stalest images
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].LastUsed.Before(candidates[j].LastUsed)
+	})
+	// checked once per run, the next run stops removing young images once enough space was reclaimed
+	pressure := len(candidates) > 0 && policy.underPressure(cli)
+	for _, candidate := range candidates {
+		_, isDangling := dangling[candidate.Id]
+		if !isDangling && now.Sub(candidate.LastUsed) < policy.MinAge && !pressure {
+			continue
+		}
+		size, removed, err := removeImage(cli, candidate.Id)
+		if err != nil {
+			// e.g. a container was created from it in the meantime
+			log.Error("error while removing image ", candidate.Id, ": ", err)
+			continue
+		}
+		if removed {
+			report.Removed = append(report.Removed, candidate.Id)
+			report.Reclaimed += size
+		}
+		err = containers.UpdateTrackedImages(func(images map[string]containers.TrackedImage) {
+			delete(images, candidate.Id)
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	log.Info("image gc removed ", len(report.Removed), " images, reclaimed ", report.Reclaimed, " bytes")
+	return report, nil
+}
+
+func removeImage(cli *client.Client, id string) (size int64, removed bool, err error) {
+	inspect, err := cli.ImageInspect(context.Background(), id)
+	if client.IsErrNotFound(err) {
+		// already gone, it only has to be forgotten
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	log.Info("removing unreferenced image ", id, " ", inspect.RepoTags)
+	// never forced, the engine refuses to remove images that are in use
+	_, err = cli.ImageRemove(context.Background(), id, image.RemoveOptions{
+		PruneChildren: true,
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return inspect.Size, true, nil
+}
+
+// danglingImages returns the ids of the untagged images that aren't the parent of another image
+func danglingImages(cli *client.Client) (ids map[string]struct{}, err error) {
+	images, err := cli.ImageList(context.Background(), image.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("dangling", "true")),
+	})
+	if err != nil {
+		return nil, err
+	}
+	ids = make(map[string]struct{}, len(images))
+	for _, summary := range images {
+		ids[summary.ID] = struct{}{}
+	}
+	return ids, nil
+}
@@ -3,14 +3,18 @@ package machine
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"slices"
 	"strings"
 	"supervisor/containers"
 	"supervisor/machine/hardware"
+	"sync"
+	"time"
 )
 
 const prefix = "sb-"
@@ -21,6 +25,17 @@ type Machine struct {
 	Hardware   hardware.Hardware      `json:"hardware"`
 	Key        string                 `json:"key"`
 	Containers []containers.Container `json:"containers"`
+	Stacks     []containers.Stack     `json:"stacks"`
+	Allocator  *Allocator             `json:"-"`
+	// held while the containers are updated, the firewall reconciler skips its round meanwhile
+	lock sync.Mutex
+	// guards Containers and acting, the goroutines that don't hold lock read them through Snapshot
+	containersLock sync.RWMutex
+	// the containers an action is running on, their firewall is left to the action
+	acting map[string]struct{}
+	// held while the host firewall changes, the timer restores the previous one unless it's confirmed
+	hostLock   sync.Mutex
+	hostRevert *time.Timer
 }
 
 func GetMachine(cli *client.Client) (machine *Machine, err error) {
@@ -53,28 +68,46 @@ func GetMachine(cli *client.Client) (machine *Machine, err error) {
 				id = strings.ReplaceAll(name, completePrefix, "")
 			}
 		}
+		if containers.IsAuxiliaryName(id) {
+			// left behind by an interrupted update, cleaned up on the next update of that container
+			continue
+		}
 		specifics, err := cli.ContainerInspect(context.Background(), dockerContainer.ID)
 		if err != nil {
 			return machine, err
 		}
-		var address string
+		addresses := make([]string, 0)
 		for _, binding := range specifics.HostConfig.PortBindings {
 			for _, port := range binding {
-				address = port.HostIP
+				if !slices.Contains(addresses, port.HostIP) {
+					addresses = append(addresses, port.HostIP)
+				}
 			}
-			break
+		}
+		// bindings are a map, sorted so the primary address is stable
+		slices.Sort(addresses)
+		var address string
+		if len(addresses) > 0 {
+			address = addresses[0]
 		}
 		var mount string
-		for _, mnt := range dockerContainer.Mounts {
-			mount = mnt.Destination
+		// the container directory is always the first mount
+		if len(specifics.HostConfig.Mounts) > 0 {
+			mount = specifics.HostConfig.Mounts[0].Target
 		}
 		finalContainer := containers.Container{
-			Id:      id,
-			Image:   dockerContainer.Image,
-			Address: address,
-			Mount:   mount,
-			Envs:    map[string]string{},
-			Ports:   []containers.Port{},
+			Id:          id,
+			Image:       dockerContainer.Image,
+			Address:     address,
+			Addresses:   addresses,
+			Mount:       mount,
+			Envs:        map[string]string{},
+			Ports:       []containers.Port{},
+			StopTimeout: specifics.Config.StopTimeout,
+			Stack:       containers.StackOf(specifics.Config.Labels),
+		}
+		if specifics.Config.StopSignal != "" {
+			finalContainer.StopSignal = &specifics.Config.StopSignal
 		}
 		err = finalContainer.ReadyFs()
 		if err != nil {
@@ -90,10 +123,81 @@ func GetMachine(cli *client.Client) (machine *Machine, err error) {
 		Key:        key,
 		Hardware:   *hw,
 		Containers: finalContainers,
+		Allocator:  NewAllocator(),
+		acting:     make(map[string]struct{}),
 	}, nil
 }
 
-func (m *Machine) UpdateContainers(cli *client.Client, newContainers []containers.Container) (created []containers.Container, err error) {
+// Snapshot returns a copy of the managed containers, safe to iterate while they are being updated
+func (m *Machine) Snapshot() []containers.Container {
+	m.containersLock.RLock()
+	defer m.containersLock.RUnlock()
+	return slices.Clone(m.Containers)
+}
+
+// HasStacks reports whether any managed container is a stack member
+func (m *Machine) HasStacks() bool {
+	for _, c := range m.Snapshot() {
+		if c.Stack != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Act runs an action on a container without holding lock, so updates and the reconciler go on during pulls
+// and clones. They leave the firewall of the container alone until record applied the changes of the action,
+// under lock, otherwise they would reinstall the firewall of its previous spec
+func (m *Machine) Act(id string, action func(), record func()) {
+	m.containersLock.Lock()
+	m.acting[id] = struct{}{}
+	m.containersLock.Unlock()
+	defer func() {
+		m.containersLock.Lock()
+		delete(m.acting, id)
+		m.containersLock.Unlock()
+	}()
+	action()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	record()
+}
+
+// isActing reports whether an action is running on the container
+func (m *Machine) isActing(id string) bool {
+	m.containersLock.RLock()
+	defer m.containersLock.RUnlock()
+	_, acting := m.acting[id]
+	return acting
+}
+
+// UpdateContainer applies changes to a managed container, it's a no-op if the container isn't managed
+func (m *Machine) UpdateContainer(id string, update func(c *containers.Container)) {
+	m.containersLock.Lock()
+	defer m.containersLock.Unlock()
+	for i := range m.Containers {
+		if m.Containers[i].Id == id {
+			update(&m.Containers[i])
+		}
+	}
+}
+
+// UpdateContainers reconciles the standalone containers and the stack members, stack members are created
+// in dependency order
+func (m *Machine) UpdateContainers(cli *client.Client, newContainers []containers.Container, newStacks []containers.Stack) (created []containers.Container, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, stack := range newStacks {
+		err = stack.Validate()
+		if err != nil {
+			return nil, err
+		}
+		members, err := stack.Members()
+		if err != nil {
+			return nil, err
+		}
+		newContainers = append(newContainers, members...)
+	}
 	toBeCreated := make([]containers.Container, 0)
 	toBeDeleted := make(map[string]containers.Container)
 	existing := make([]containers.Container, 0)
@@ -103,7 +207,7 @@ func (m *Machine) UpdateContainers(cli *client.Client, newContainers []container
 	for i := range newContainers {
 		provided := &newContainers[i]
 		if len(provided.Replacements) == 0 {
-			panic("replacements is required")
+			return nil, fmt.Errorf("container %s has no replacements", provided.Id)
 		}
 		if _, exists := toBeDeleted[provided.Id]; exists {
 			existing = append(existing, *provided)
@@ -120,18 +224,54 @@ func (m *Machine) UpdateContainers(cli *client.Client, newContainers []container
 		}
 	}
 	for _, createdContainer := range toBeCreated {
+		err = m.checkPorts(cli, createdContainer, newContainers)
+		if err != nil {
+			return toBeCreated, err
+		}
 		err = createdContainer.Create(cli)
 		if err != nil {
 			return toBeCreated, err
 		}
+		m.Allocator.release(createdContainer.Id)
 	}
 	for _, existingContainer := range existing {
+		if m.isActing(existingContainer.Id) {
+			log.Info("an action is running on ", existingContainer.Id, ", it installs the firewall")
+			continue
+		}
+		if existingContainer.Stack != nil {
+			changed, err := existingContainer.SpecChanged(cli)
+			if err != nil {
+				return toBeCreated, err
+			}
+			if changed {
+				// the update installs the firewall as well
+				log.Info("stack member ", existingContainer.Id, " changed, updating it")
+				err = m.checkPorts(cli, existingContainer, newContainers)
+				if err != nil {
+					return toBeCreated, err
+				}
+				err = existingContainer.Update(cli, false, nil)
+				if err != nil {
+					return toBeCreated, err
+				}
+				m.Allocator.release(existingContainer.Id)
+				continue
+			}
+		}
 		err = existingContainer.InstallFirewall()
 		if err != nil {
 			return toBeCreated, err
 		}
 	}
+	err = containers.CollectNetworks(cli)
+	if err != nil {
+		return toBeCreated, err
+	}
+	m.containersLock.Lock()
 	m.Containers = newContainers
+	m.Stacks = newStacks
+	m.containersLock.Unlock()
 	log.Info(len(toBeCreated), " created containers, ", len(toBeDeleted), " deleted containers, ", len(newContainers), " final containers")
 	return toBeCreated, nil
 }
@@ -0,0 +1,115 @@
+package machine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"supervisor/containers"
+	"sync"
+
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// stoppedPath is where the containers stopped by a shutdown are recorded: explicitly stopped containers aren't
+// started again by their restart policy, so the next start of the daemon does it
+func stoppedPath() (string, error) {
+	return containers.StateDir("stopped.json")
+}
+
+// StopContainers gracefully stops the running containers when the daemon shuts down, so they get their stop
+// command. Standalone containers and stacks are stopped concurrently, stack members in reverse dependency order
+func (m *Machine) StopContainers(cli *client.Client) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	groups := make(map[string][]containers.Container)
+	stopped := make([]string, 0)
+	for _, c := range m.Snapshot() {
+		running, err := c.Running(cli)
+		if err != nil {
+			return err
+		}
+		if !running {
+			continue
+		}
+		stopped = append(stopped, c.Id)
+		group := "container." + c.Id
+		if c.Stack != nil {
+			group = "stack." + *c.Stack
+		}
+		// stack members are managed in dependency order
+		groups[group] = append(groups[group], c)
+	}
+	path, err := stoppedPath()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(stopped)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	var errsLock sync.Mutex
+	var errs []error
+	for _, group := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := len(group) - 1; i >= 0; i-- {
+				log.Info("stopping ", group[i].Id, " for shutdown")
+				err := group[i].Stop(cli)
+				if err != nil {
+					errsLock.Lock()
+					errs = append(errs, fmt.Errorf("error stopping %s: %w", group[i].Id, err))
+					errsLock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// ResumeContainers starts the containers stopped by the last shutdown, in dependency order
+func (m *Machine) ResumeContainers(cli *client.Client) (err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	path, err := stoppedPath()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	stopped := make([]string, 0)
+	err = json.Unmarshal(data, &stopped)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, c := range m.Snapshot() {
+		if !slices.Contains(stopped, c.Id) {
+			continue
+		}
+		log.Info("starting ", c.Id, " stopped by the last shutdown")
+		err = c.Start(cli)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error starting %s: %w", c.Id, err))
+		}
+	}
+	err = errors.Join(errs...)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
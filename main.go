@@ -2,10 +2,22 @@ package main
 
 import (
 	docker "github.com/docker/docker/client"
+	"os"
+	"os/signal"
 	"supervisor/client"
+	"supervisor/containers"
+	"syscall"
 )
 
 func main() {
+	// run as "serverbench uninstall" when the daemon is removed from the host
+	if len(os.Args) > 1 && os.Args[1] == "uninstall" {
+		err := containers.TeardownFirewalls()
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
 	cli, err := docker.NewClientWithOpts(
 		docker.FromEnv,
 		docker.WithVersion("1.47"),
@@ -15,6 +27,14 @@ func main() {
 	}
 	defer cli.Close()
 	serverbench := client.Client{}
+	// the containers get their stop command before the daemon exits
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		serverbench.Shutdown()
+		os.Exit(0)
+	}()
 	err = serverbench.Start(cli)
 	if err != nil {
 		panic(err)
@@ -0,0 +1,30 @@
+#!/bin/sh
+
+# Detect iptables variants, as install.sh does
+if iptables --version 2>&1 | grep -q nf; then
+  IPTABLES_BIN="iptables"
+else
+  IPTABLES_BIN="iptables-legacy"
+fi
+
+if ip6tables --version 2>&1 | grep -q nf; then
+  IP6TABLES_BIN="ip6tables"
+else
+  IP6TABLES_BIN="ip6tables-legacy"
+fi
+
+# Stop the daemon and its autoupdate first, so nothing reinstalls the firewall meanwhile
+docker rm -f serverbench-wt 2>/dev/null || true
+docker rm -f serverbench 2>/dev/null || true
+
+echo "Removing serverbench firewall rules..."
+docker run --rm \
+  --privileged \
+  --cap-add=NET_ADMIN \
+  -v /proc/1/ns/net:/mnt/host_netns \
+  -e IPTABLES_BIN="$IPTABLES_BIN" \
+  -e IP6TABLES_BIN="$IP6TABLES_BIN" \
+  --entrypoint /app/serverbench \
+  --pid=host --network=host serverbench/daemon uninstall
+
+echo "serverbench uninstalled"